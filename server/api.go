@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	APIPrefix = "/api/v1/"
+)
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiQueueBody struct {
+	Index        int          `json:"index"`
+	MinimumIndex int          `json:"minimum_index"`
+	MaximumIndex int          `json:"maximum_index"`
+	Items        []QueueEntry `json:"items"`
+}
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(APIPrefix+"status", requireRole(RoleListener, apiStatusHandler))
+	mux.HandleFunc(APIPrefix+"queue", requireRoles(RoleListener, RoleDJ, apiQueueHandler))
+	mux.HandleFunc(APIPrefix+"queue/", requireRoles(RoleListener, RoleDJ, apiTrackHandler))
+	mux.HandleFunc(APIPrefix+"play", requireRole(RoleDJ, apiControlHandler((*Player).Play)))
+	mux.HandleFunc(APIPrefix+"pause", requireRole(RoleDJ, apiControlHandler((*Player).Pause)))
+	mux.HandleFunc(APIPrefix+"next", requireRole(RoleDJ, apiControlHandler((*Player).Next)))
+	mux.HandleFunc(APIPrefix+"previous", requireRole(RoleDJ, apiControlHandler((*Player).Previous)))
+	mux.HandleFunc(APIPrefix, apiNotFoundHandler)
+}
+
+// writeJSON respond with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeError respond with a JSON error body
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiErrorBody{Error: apiError{Status: status, Message: message}})
+}
+
+// allowMethods respond with 405 and return false when the request's method isn't one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, 405, fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path))
+	return false
+}
+
+func apiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	writeJSON(w, 200, playerOf(r).Status())
+}
+
+func apiQueueHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET", "DELETE") {
+		return
+	}
+	if r.Method == "DELETE" {
+		err := playerOf(r).Clear()
+		if err != nil {
+			writeError(w, 500, "Failed to clear queue: "+err.Error())
+			return
+		}
+	}
+	writeQueue(w, playerOf(r))
+}
+
+// writeQueue respond with every retrievable queue item
+func writeQueue(w http.ResponseWriter, player *Player) {
+	status := player.Status()
+	writeJSON(w, 200, apiQueueBody{
+		Index:        status.Index,
+		MinimumIndex: status.MinimumIndex,
+		MaximumIndex: status.MaximumIndex,
+		Items:        player.Entries(),
+	})
+}
+
+func apiTrackHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	indexStr := strings.TrimPrefix(r.URL.Path, APIPrefix+"queue/")
+	action := ""
+	if slash := strings.Index(indexStr, "/"); slash != -1 {
+		indexStr, action = indexStr[:slash], indexStr[slash+1:]
+	}
+	index, parseErr := strconv.Atoi(indexStr)
+	if parseErr != nil {
+		writeError(w, 400, fmt.Sprintf("Invalid queue index %q", indexStr))
+		return
+	}
+	player := playerOf(r)
+	switch action {
+	case "":
+		if !allowMethods(w, r, "GET", "DELETE") {
+			return
+		}
+		if r.Method == "DELETE" {
+			apiEditQueue(w, player, player.Remove(index))
+			return
+		}
+	case "cover":
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+	case "move":
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		to, toErr := strconv.Atoi(r.FormValue("to"))
+		if toErr != nil {
+			writeError(w, 400, fmt.Sprintf("Invalid destination index %q", r.FormValue("to")))
+			return
+		}
+		apiEditQueue(w, player, player.Move(index, to))
+		return
+	default:
+		writeError(w, 404, fmt.Sprintf("Unknown API endpoint %s", r.URL.Path))
+		return
+	}
+	isCover := action == "cover"
+	entry, err := player.Entry(index)
+	if err != nil {
+		writeError(w, 404, fmt.Sprintf("No queue item at index %d: %s", index, err))
+		return
+	}
+	if isCover {
+		if !entry.Meta.Info.HasCover {
+			writeError(w, 404, fmt.Sprintf("Queue item %d has no cover art", index))
+			return
+		}
+		writeCover(w, entry.Meta.Info)
+		return
+	}
+	writeJSON(w, 200, entry)
+}
+
+// apiEditQueue respond to a queue edit with the resulting queue, or why it failed
+func apiEditQueue(w http.ResponseWriter, player *Player, err error) {
+	if err != nil {
+		switch err.Error() {
+		case "IndexOutOfRange":
+			writeError(w, 404, "No queue item at that index")
+		case "CannotRemoveCurrent":
+			writeError(w, 409, "The current item can't be removed; skip it first")
+		default:
+			writeError(w, 500, "Failed to edit queue: "+err.Error())
+		}
+		return
+	}
+	writeQueue(w, player)
+}
+
+// apiControlHandler wrap a player action so it responds with the resulting player status
+func apiControlHandler(action func(p *Player)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleChores(w, r)
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		action(playerOf(r))
+		writeJSON(w, 200, playerOf(r).Status())
+	}
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	writeError(w, 404, fmt.Sprintf("Unknown API endpoint %s", r.URL.Path))
+}
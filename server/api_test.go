@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPIMux() *http.ServeMux {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux)
+	return mux
+}
+
+func doTestRequest(mux *http.ServeMux, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestAPIStatus(t *testing.T) {
+	mux := newTestAPIMux()
+	rec := doTestRequest(mux, "GET", APIPrefix+"status")
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var status PlayerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("json.Unmarshal() raised error %s", err)
+	}
+	if status.Playing || status.Paused || status.Index != -1 {
+		t.Errorf("Unexpected idle status %+v", status)
+	}
+}
+
+func TestAPIQueue(t *testing.T) {
+	mux := newTestAPIMux()
+	for i := 0; i < 3; i++ {
+		PlayerInst.Enqueue(generateTestTrack(time.Second))
+	}
+	rec := doTestRequest(mux, "GET", APIPrefix+"queue")
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var body apiQueueBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json.Unmarshal() raised error %s", err)
+	}
+	if len(body.Items) != 3 || body.MaximumIndex != 3 {
+		t.Fatalf("Expected 3 queue items, got %+v", body)
+	}
+	for i, item := range body.Items {
+		if item.Index != i || item.Meta.Size == 0 {
+			t.Errorf("Unexpected queue item %+v", item)
+		}
+	}
+	rec = doTestRequest(mux, "GET", APIPrefix+"queue/1")
+	if rec.Code != 200 {
+		t.Errorf("Expected status 200 for queue item, got %d", rec.Code)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	mux := newTestAPIMux()
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", APIPrefix + "queue/42", 404},
+		{"GET", APIPrefix + "queue/nope", 400},
+		{"GET", APIPrefix + "next", 405},
+		{"POST", APIPrefix + "status", 405},
+		{"GET", APIPrefix + "nothing", 404},
+	}
+	for _, c := range cases {
+		rec := doTestRequest(mux, c.method, c.path)
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d", c.method, c.path, c.status, rec.Code)
+			continue
+		}
+		var body apiErrorBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Status != c.status {
+			t.Errorf("%s %s: invalid error body %q", c.method, c.path, rec.Body.String())
+		}
+	}
+}
+
+func TestAPIQueueEdit(t *testing.T) {
+	mux := newTestAPIMux()
+	for i := 1; i <= 4; i++ {
+		PlayerInst.Enqueue(generateTestTrack(time.Duration(i) * time.Second)) // told apart by their sizes
+	}
+	last, _ := PlayerInst.Entry(3)
+	queueSizes := func(rec *httptest.ResponseRecorder) (sizes []int64) {
+		var body apiQueueBody
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		for _, item := range body.Items {
+			sizes = append(sizes, item.Meta.Size)
+		}
+		return
+	}
+	rec := doTestRequest(mux, "DELETE", APIPrefix+"queue/1")
+	if rec.Code != 200 || len(queueSizes(rec)) != 3 {
+		t.Fatalf("Unexpected remove response %d %s", rec.Code, rec.Body)
+	}
+	rec = doTestRequest(mux, "POST", APIPrefix+"queue/2/move?to=0")
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected move response %d %s", rec.Code, rec.Body)
+	}
+	entry, _ := PlayerInst.Entry(0)
+	if entry.Meta.Size != last.Meta.Size {
+		t.Errorf("Expected moved item at index 0, got %+v", entry)
+	}
+	for path, expected := range map[string]int{
+		"queue/9":               404,
+		"queue/x":               400,
+		"queue/0/move?to=9":     404,
+		"queue/0/move?to=first": 400,
+		"queue/0/rename":        404,
+	} {
+		method := "DELETE"
+		if strings.Contains(path, "/move") {
+			method = "POST"
+		}
+		if rec = doTestRequest(mux, method, APIPrefix+path); rec.Code != expected {
+			t.Errorf("Expected status %d for %s %s, got %d", expected, method, path, rec.Code)
+		}
+	}
+	rec = doTestRequest(mux, "DELETE", APIPrefix+"queue")
+	if rec.Code != 200 || len(queueSizes(rec)) != 0 {
+		t.Errorf("Expected empty queue after clearing, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Role level of access to the server; each role includes the permissions of the roles below it
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleListener
+	RoleFollower // another server following this one's playback, which copies its tracks
+	RoleDJ
+	RoleAdmin
+)
+
+var (
+	roleNames = map[string]Role{
+		"":         RoleNone,
+		"none":     RoleNone,
+		"listener": RoleListener,
+		"follower": RoleFollower,
+		"dj":       RoleDJ,
+		"admin":    RoleAdmin,
+	}
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleListener:
+		return "listener"
+	case RoleFollower:
+		return "follower"
+	case RoleDJ:
+		return "dj"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func (r *Role) UnmarshalJSON(data []byte) error {
+	var name string
+	err := json.Unmarshal(data, &name)
+	if err != nil {
+		return err
+	}
+	role, ok := roleNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("UnknownRole %q", name)
+	}
+	*r = role
+	return nil
+}
+
+// AuthConfig users & API tokens allowed to use the server
+type AuthConfig struct {
+	Users     []AuthUser  `json:"users"`
+	Tokens    []AuthToken `json:"tokens"`
+	Anonymous Role        `json:"anonymous"` // role of requests without credentials
+}
+
+// AuthUser basic-auth user; exactly one of Password or PasswordSHA256 (hex) should be set
+type AuthUser struct {
+	Name           string `json:"name"`
+	Password       string `json:"password,omitempty"`
+	PasswordSHA256 string `json:"password_sha256,omitempty"`
+	Role           Role   `json:"role"`
+}
+
+// AuthToken API token, sent as "Authorization: Bearer <token>" or the token query parameter
+type AuthToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// Authenticator decides the role of each request; safe to reload while serving
+type Authenticator struct {
+	mu     sync.RWMutex
+	config AuthConfig
+}
+
+// LoadAuthConfig read an AuthConfig from a JSON file
+func LoadAuthConfig(filename string) (config AuthConfig, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return
+	}
+	err = validateAuthConfig(config)
+	return
+}
+
+// validateAuthConfig check every user has a password & every token has a value
+func validateAuthConfig(config AuthConfig) error {
+	for _, u := range config.Users {
+		if u.Name == "" || (u.Password == "" && u.PasswordSHA256 == "") {
+			return errors.New("InvalidAuthUser")
+		}
+	}
+	for _, t := range config.Tokens {
+		if t.Token == "" {
+			return errors.New("InvalidAuthToken")
+		}
+	}
+	return nil
+}
+
+func NewAuthenticator(config AuthConfig) *Authenticator {
+	return &Authenticator{config: config}
+}
+
+// SetConfig replace the users & tokens
+func (a *Authenticator) SetConfig(config AuthConfig) {
+	a.mu.Lock()
+	a.config = config
+	a.mu.Unlock()
+}
+
+// RoleOf determine the role of a request. ok is false when credentials were supplied but are invalid.
+func (a *Authenticator) RoleOf(r *http.Request) (role Role, ok bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if token := requestToken(r); token != "" {
+		for _, t := range a.config.Tokens {
+			if secureCompare(token, t.Token) {
+				return t.Role, true
+			}
+		}
+		return RoleNone, false
+	}
+	if name, password, hasBasic := r.BasicAuth(); hasBasic {
+		for _, u := range a.config.Users {
+			if u.Name == name && u.checkPassword(password) {
+				return u.Role, true
+			}
+		}
+		return RoleNone, false
+	}
+	return a.config.Anonymous, true
+}
+
+func (u *AuthUser) checkPassword(password string) bool {
+	if u.PasswordSHA256 != "" {
+		sum := sha256.Sum256([]byte(password))
+		return secureCompare(hex.EncodeToString(sum[:]), strings.ToLower(u.PasswordSHA256))
+	}
+	return secureCompare(password, u.Password)
+}
+
+func requestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// requireRole only call handler for requests of at least role (everyone, when Auth is nil)
+func requireRole(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return requireRoles(role, role, handler)
+}
+
+// requireRoles like requireRole, with a separate role for requests which only read (GET & HEAD)
+func requireRoles(readRole, writeRole Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Auth == nil {
+			handler(w, r)
+			return
+		}
+		needed := writeRole
+		if r.Method == "GET" || r.Method == "HEAD" {
+			needed = readRole
+		}
+		role, ok := Auth.RoleOf(r)
+		_, _, hasBasic := r.BasicAuth()
+		hasCredentials := hasBasic || requestToken(r) != ""
+		if !ok || (role < needed && !hasCredentials) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Internet of Music"`)
+			writeError(w, 401, "Valid credentials are required")
+			return
+		}
+		if role < needed {
+			writeError(w, 403, fmt.Sprintf("The %s role is required; you are a %s", needed, role))
+			return
+		}
+		handler(w, r)
+	}
+}
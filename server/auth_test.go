@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	sum := sha256.Sum256([]byte("hashed"))
+	Auth = NewAuthenticator(AuthConfig{
+		Users: []AuthUser{
+			{Name: "alice", Password: "plain", Role: RoleDJ},
+			{Name: "bob", PasswordSHA256: hex.EncodeToString(sum[:]), Role: RoleAdmin},
+		},
+		Tokens:    []AuthToken{{Name: "kiosk", Token: "secret", Role: RoleListener}},
+		Anonymous: RoleListener,
+	})
+	defer func() { Auth = nil }()
+	handler := requireRoles(RoleListener, RoleDJ, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		user     string
+		password string
+		bearer   string
+		expected int
+	}{
+		{"anonymous read", "GET", "/", "", "", "", 204},
+		{"anonymous write", "POST", "/", "", "", "", 401},
+		{"plain password", "POST", "/", "alice", "plain", "", 204},
+		{"hashed password", "POST", "/", "bob", "hashed", "", 204},
+		{"wrong password", "GET", "/", "alice", "hashed", "", 401},
+		{"unknown user", "GET", "/", "eve", "plain", "", 401},
+		{"bearer token read", "GET", "/", "", "", "secret", 204},
+		{"bearer token write", "POST", "/", "", "", "secret", 403},
+		{"query token", "POST", "/?token=secret", "", "", "", 403},
+		{"bad token", "GET", "/?token=wrong", "", "", "", 401},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		if c.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+c.bearer)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		if rec.Code != c.expected {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.expected, rec.Code)
+		}
+		if rec.Code == 401 && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", c.name)
+		}
+	}
+}
+
+func TestRequireRoleDisabled(t *testing.T) {
+	Auth = nil
+	rec := httptest.NewRecorder()
+	requireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != 204 {
+		t.Errorf("Expected status 204 without auth, got %d", rec.Code)
+	}
+}
+
+func TestLoadAuthConfig(t *testing.T) {
+	filename := "auth_test.json"
+	defer os.Remove(filename)
+	ioutil.WriteFile(filename, []byte(`{"users":[{"name":"alice","password":"pw","role":"DJ"}],"anonymous":"listener"}`), 0644)
+	config, err := LoadAuthConfig(filename)
+	if err != nil {
+		t.Fatalf("LoadAuthConfig() raised error %s", err)
+	}
+	if len(config.Users) != 1 || config.Users[0].Role != RoleDJ || config.Anonymous != RoleListener {
+		t.Errorf("Unexpected auth config %+v", config)
+	}
+	ioutil.WriteFile(filename, []byte(`{"users":[{"name":"alice","role":"dj"}]}`), 0644)
+	if _, err = LoadAuthConfig(filename); err == nil {
+		t.Errorf("Expected error for user without password")
+	}
+	ioutil.WriteFile(filename, []byte(`{"anonymous":"superuser"}`), 0644)
+	if _, err = LoadAuthConfig(filename); err == nil {
+		t.Errorf("Expected error for unknown role")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	QueueStoreDisk   = "disk"
+	QueueStoreMemory = "memory"
+	blobTmpSuffix    = ".tmp"
+)
+
+// BlobStore somewhere RollingQueue keeps items which don't fit in memory.
+// A store belongs to one queue, which clears it when it starts so nothing is left over from a crash.
+type BlobStore interface {
+	// Put store everything read from r under key, replacing what was there; a failed Put leaves nothing behind
+	Put(key string, r io.Reader) error
+	// Get open what is stored under key
+	Get(key string) (ReadSeekerCloser, error)
+	// Rename move what is stored under from to to, replacing what was there
+	Rename(from, to string) error
+	// Delete remove what is stored under key; it isn't an error when there's nothing there
+	Delete(key string) error
+	// Used bytes stored
+	Used() int64
+	// Clear remove everything stored
+	Clear() error
+}
+
+// blobQuota check that replacing a blob of oldSize with one of newSize keeps used within quota (0 for no limit)
+func blobQuota(quota, used, oldSize, newSize int64) error {
+	if quota > 0 && used-oldSize+newSize > quota {
+		return errors.New("QuotaExceeded")
+	}
+	return nil
+}
+
+// FileBlobStore blobs kept as files in a directory, named by a prefix and their key
+type FileBlobStore struct {
+	mu     sync.Mutex
+	dir    string
+	prefix string
+	quota  int64
+	sizes  map[string]int64
+	used   int64
+}
+
+// NewFileBlobStore store blobs in dir (the working directory when empty), using at most quota bytes (0 for no limit)
+func NewFileBlobStore(dir, prefix string, quota int64) (*FileBlobStore, error) {
+	if dir == "" {
+		dir = "."
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir, prefix: prefix, quota: quota, sizes: map[string]int64{}}, nil
+}
+
+func (s *FileBlobStore) filename(key string) string {
+	return filepath.Join(s.dir, s.prefix+key)
+}
+
+func (s *FileBlobStore) Put(key string, r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := ioutil.TempFile(s.dir, s.prefix+key+blobTmpSuffix)
+	if err != nil {
+		return err
+	}
+	if s.quota > 0 {
+		// read one byte too many to tell when the quota would be exceeded
+		r = io.LimitReader(r, s.quota-s.used+s.sizes[key]+1)
+	}
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		err = blobQuota(s.quota, s.used, s.sizes[key], size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.filename(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.used += size - s.sizes[key]
+	s.sizes[key] = size
+	return nil
+}
+
+func (s *FileBlobStore) Get(key string) (ReadSeekerCloser, error) {
+	return os.Open(s.filename(key))
+}
+
+func (s *FileBlobStore) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Rename(s.filename(from), s.filename(to))
+	if err != nil {
+		return err
+	}
+	s.used -= s.sizes[to]
+	s.sizes[to] = s.sizes[from]
+	delete(s.sizes, from)
+	return nil
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.filename(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.used -= s.sizes[key]
+	delete(s.sizes, key)
+	return nil
+}
+
+func (s *FileBlobStore) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Clear remove every file with the store's prefix, including ones written before a crash
+func (s *FileBlobStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), s.prefix) {
+			removeErr := os.Remove(filepath.Join(s.dir, info.Name()))
+			if removeErr != nil && err == nil {
+				err = removeErr
+			}
+		}
+	}
+	s.sizes = map[string]int64{}
+	s.used = 0
+	return err
+}
+
+// MemoryBlobStore blobs kept in memory
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	quota int64
+	blobs map[string][]byte
+	used  int64
+}
+
+// NewMemoryBlobStore store blobs in memory, using at most quota bytes (0 for no limit)
+func NewMemoryBlobStore(quota int64) *MemoryBlobStore {
+	return &MemoryBlobStore{quota: quota, blobs: map[string][]byte{}}
+}
+
+func (s *MemoryBlobStore) Put(key string, r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldSize := int64(len(s.blobs[key]))
+	if s.quota > 0 {
+		r = io.LimitReader(r, s.quota-s.used+oldSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	err = blobQuota(s.quota, s.used, oldSize, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	s.used += int64(len(data)) - oldSize
+	s.blobs[key] = data
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(key string) (ReadSeekerCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, errors.New("BlobNotFound")
+	}
+	return NewWrapCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryBlobStore) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[from]
+	if !ok {
+		return errors.New("BlobNotFound")
+	}
+	s.used -= int64(len(s.blobs[to]))
+	s.blobs[to] = data
+	delete(s.blobs, from)
+	return nil
+}
+
+func (s *MemoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= int64(len(s.blobs[key]))
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryBlobStore) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+func (s *MemoryBlobStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs = map[string][]byte{}
+	s.used = 0
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBlobStores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomblobs")
+	defer os.RemoveAll(dir)
+	// a blob left behind by a crash
+	ioutil.WriteFile(filepath.Join(dir, "spilled-old"), []byte("stale"), 0644)
+	fileStore, err := NewFileBlobStore(dir, "spilled-", 10)
+	if err != nil {
+		t.Fatalf("NewFileBlobStore() raised error %s", err)
+	}
+	for name, store := range map[string]BlobStore{"file": fileStore, "memory": NewMemoryBlobStore(10)} {
+		if err := store.Clear(); err != nil {
+			t.Errorf("%s Clear() raised error %s", name, err)
+		}
+		if err := store.Put("a", strings.NewReader("12345")); err != nil {
+			t.Fatalf("%s Put() raised error %s", name, err)
+		}
+		store.Put("b", strings.NewReader("123"))
+		if err := store.Put("c", strings.NewReader("123")); err == nil || err.Error() != "QuotaExceeded" {
+			t.Errorf("Expected %s Put() over the quota to raise QuotaExceeded, got %v", name, err)
+		}
+		if _, err := store.Get("c"); err == nil {
+			t.Errorf("Expected %s Put() over the quota to store nothing", name)
+		}
+		if err := store.Put("a", strings.NewReader("1234567")); err != nil {
+			t.Errorf("Expected %s Put() replacing a blob to count it once, got %s", name, err)
+		}
+		if err := store.Rename("a", "c"); err != nil {
+			t.Errorf("%s Rename() raised error %s", name, err)
+		}
+		f, err := store.Get("c")
+		if err != nil {
+			t.Fatalf("%s Get() raised error %s", name, err)
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(data, []byte("1234567")) || store.Used() != 10 {
+			t.Errorf("Expected %s to store 1234567 in 10 bytes, got %q in %d", name, data, store.Used())
+		}
+		store.Delete("b")
+		if err := store.Delete("b"); err != nil || store.Used() != 7 {
+			t.Errorf("Expected %s Delete() to free 3 bytes, got %d used (error %v)", name, store.Used(), err)
+		}
+		if err := store.Clear(); err != nil || store.Used() != 0 {
+			t.Errorf("Expected %s Clear() to empty it, got %d used (error %v)", name, store.Used(), err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 0 {
+		t.Errorf("Leftover blob files %v", matches)
+	}
+}
+
+func TestQueueSpillInMemory(t *testing.T) {
+	defer cleanupDummyFiles()
+	qc := full_test_qc
+	qc.SpillInMemory = true
+	q, filenames := newEditTestQueue(qc, 12, 4)
+	if location, _ := q.Location(0); location != "disk" {
+		t.Errorf("Expected item 0 to be spilled, it is in %s", location)
+	}
+	expectNoPersistedFiles(t)
+	if contents := queueContents(t, q); !reflect.DeepEqual(contents, filenames) {
+		t.Errorf("Expected queue %v, got %v", filenames, contents)
+	}
+	q.Close()
+	if used := q.spill.Used(); used != 0 {
+		t.Errorf("Expected nothing spilled after closing, got %d bytes", used)
+	}
+}
+
+func TestStaleSpillsClearedOnlyAtStartup(t *testing.T) {
+	q := NewRollingQueue(full_test_qc)
+	defer q.Close()
+	for i := 0; i < 12; i++ {
+		q.Append(NewWrapCloser(strings.NewReader("item" + strconv.Itoa(i))))
+	}
+	for q.Index() < 4 {
+		q.Next()
+	}
+	// another player starting up mustn't touch items this queue has spilled
+	NewPlayer(NewNullSink())
+	other := NewRollingQueue(full_test_qc)
+	file, err := q.Open(0)
+	if err != nil {
+		t.Fatalf("Expected spilled item 0 to survive another queue starting: %s", err)
+	}
+	if data, _ := ioutil.ReadAll(file); string(data) != "item0" {
+		t.Errorf("Expected spilled item 0 to survive another queue starting, got %q", data)
+	}
+	file.Close()
+	other.Close()
+
+	dir, _ := ioutil.TempDir("", "iomspill")
+	defer os.RemoveAll(dir)
+	roomDir := filepath.Join(dir, RoomsDirname, "kitchen")
+	os.MkdirAll(roomDir, 0755)
+	stale := []string{filepath.Join(dir, FilenameStart+"3"+FilenameEnd), filepath.Join(roomDir, FilenameStart+"-kitchen-0"+FilenameEnd)}
+	kept := filepath.Join(dir, "song.mp3")
+	for _, filename := range append(stale, kept) {
+		ioutil.WriteFile(filename, []byte("data"), 0644)
+	}
+	clearStaleSpills(dir)
+	for _, filename := range stale {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("Expected stale spilled item %s to be removed", filename)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("Expected files which weren't spilled to be kept, got %s", err)
+	}
+}
+
+func TestAppendCopySpilled(t *testing.T) {
+	q := NewRollingQueue(full_test_qc)
+	defer q.Close()
+	source, _ := ioutil.TempFile("", "iomcopy")
+	defer os.Remove(source.Name())
+	source.WriteString("copied")
+	source.Seek(0, io.SeekStart)
+	index, err := q.AppendCopy(source)
+	source.Close()
+	if err != nil {
+		t.Fatalf("AppendCopy() raised error %s", err)
+	}
+	expectNoPersistedFiles(t) // the copy is only held open, not left in the spill directory
+	if used := q.spill.Used(); used != 0 {
+		t.Errorf("Expected the copy not to count as spilled, got %d bytes", used)
+	}
+	file, err := q.Open(index)
+	if err != nil {
+		t.Fatalf("Open() raised error %s", err)
+	}
+	defer file.Close()
+	if data, _ := ioutil.ReadAll(file); string(data) != "copied" {
+		t.Errorf("Expected copied item, got %q", data)
+	}
+}
@@ -5,28 +5,61 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
 const (
-	DefaultPort             = "8080"
-	DefaultBuffer           = time.Second / 10
-	DefaultMaxMemory int64  = 1024 * 1024 * 256 // 256 Mb
-	DefaultRootPath         = "."
-	DefaultSampleRate int64 = 48000
-	DefaultQuality int      = 4
+	DefaultPort                  = "8080"
+	DefaultBuffer                = time.Second / 10
+	DefaultMaxMemory       int64 = 1024 * 1024 * 256 // 256 Mb
+	DefaultRootPath              = "."
+	DefaultSampleRate      int64 = 48000
+	DefaultQuality         int   = 4
+	DefaultVolume          int   = 100
+	DefaultCrossfade             = time.Duration(0)
+	DefaultOutput                = OutputSpeaker
+	DefaultWavPath               = "output.wav"
+	JournalDirname               = "queue"
+	DefaultQueueBuffer           = 2
+	DefaultQueueOvercache        = 2
+	DefaultShutdownTimeout       = 10 * time.Second
+	DefaultQueueStore            = QueueStoreDisk
 )
 
 var (
-	Port       string
-	Buffer     time.Duration
-	MaxMemory  int64
-	RootPath   string
-	SampleRate int64
-	Quality    int
-	Version    bool
-	Debug      bool
+	Port             string
+	Buffer           time.Duration
+	MaxMemory        int64
+	RootPath         string
+	SampleRate       int64
+	Quality          int
+	Volume           int
+	Crossfade        time.Duration
+	Output           string
+	WavPath          string
+	Stream           bool
+	Journal          bool
+	AuthPath         string
+	LibraryDirs      string
+	ConfigPath       string
+	QueueBuffer      = DefaultQueueBuffer
+	QueueOvercache   = DefaultQueueOvercache
+	QueuePersist     bool
+	QueueTimeout     time.Duration
+	QueueStore       string
+	QueueDir         string
+	QueueQuota       int64
+	Formats          string
+	Origins          string
+	ShutdownTimeout  time.Duration
+	Follow           string
+	SyncTolerance    time.Duration
+	commandLineFlags map[string]bool // flags given on the command line, which the config file can't override
+	Version          bool
+	Debug            bool
 )
 
 func initCommandLineArgs() {
@@ -37,18 +70,54 @@ func initCommandLineArgs() {
 	flag.BoolVar(&Version, "version", false, "Print version information and exit")
 	flag.Int64Var(&SampleRate, "sample", DefaultSampleRate, "Sample rate to output")
 	flag.IntVar(&Quality, "quality", DefaultQuality, "Resampling quality; higher number = higher quality & CPU usage")
-    flag.BoolVar(&Debug, "debug", false, "Enable debug endpoints & logging")
+	flag.IntVar(&Volume, "volume", DefaultVolume, "Initial output volume, as a percentage")
+	flag.DurationVar(&Crossfade, "crossfade", DefaultCrossfade, "Crossfade length between tracks; 0 for gapless playback")
+	flag.StringVar(&Output, "output", DefaultOutput, "Audio output; one of speaker, null or wav")
+	flag.StringVar(&AuthPath, "auth", "", "JSON file of users, API tokens & roles; authentication is disabled when empty")
+	flag.BoolVar(&Journal, "journal", false, "Journal the queue in the root directory so it survives restarts")
+	flag.StringVar(&WavPath, "wavfile", DefaultWavPath, "File to record to when using the wav output")
+	flag.BoolVar(&Stream, "stream", false, "Also stream the output to HTTP listeners on /stream")
+	flag.StringVar(&LibraryDirs, "library", "", "Comma-separated directories of music to index for /library; relative ones are inside the root directory")
+	flag.BoolVar(&Debug, "debug", false, "Enable debug endpoints & logging")
+	flag.StringVar(&ConfigPath, ConfigFlag, "", "JSON config file of settings named like these flags; IOM_* environment variables override it, and flags override both")
+	flag.IntVar(&QueueBuffer, "queue-buffer", DefaultQueueBuffer, "Queue items kept in memory either side of the current one")
+	flag.IntVar(&QueueOvercache, "queue-overcache", DefaultQueueOvercache, "Extra queue items kept in memory before spilling to disk; 0 to disable")
+	flag.BoolVar(&QueuePersist, "queue-persist", false, "Spill queue items which don't fit in memory to disk")
+	flag.DurationVar(&QueueTimeout, "queue-timeout", 0, "Longest to wait for a queue item to load; 0 waits as long as it takes")
+	flag.StringVar(&QueueStore, "queue-store", DefaultQueueStore, "Where queue items which don't fit in memory are spilled; one of disk or memory")
+	flag.StringVar(&QueueDir, "queue-dir", "", "Directory to spill queue items to; relative ones are inside the root directory, which is used when empty")
+	flag.Int64Var(&QueueQuota, "queue-quota", 0, "Most bytes of queue items spilled at once; 0 for no limit")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "Longest to wait for requests to finish when shutting down")
+	flag.StringVar(&Follow, "follow", "", "Base URL of a leader server to play in time with, eg http://host:8080; its queue replaces this one's")
+	flag.DurationVar(&SyncTolerance, "sync-tolerance", DefaultSyncTolerance, "Drift from the leader, on top of the audio buffer, allowed before seeking back in time")
+	flag.StringVar(&Formats, "formats", DefaultFormats, "Comma-separated audio formats which may be queued, out of "+DefaultFormats)
+	flag.StringVar(&Origins, "origins", "", "Comma-separated origins of other sites which may open WebSockets, eg https://example.com")
 }
 
-func processCommandLineArgs() {
+func processCommandLineArgs() (err error) {
 	flag.Parse()
+	commandLineFlags, err = loadConfiguration(flag.CommandLine, os.LookupEnv)
+	return
+}
+
+// ReloadConfiguration re-read the config file & environment, as on SIGHUP, and report what couldn't change live
+func ReloadConfiguration() {
+	needRestart, err := reloadConfiguration(flag.CommandLine, commandLineFlags, os.LookupEnv)
+	if err != nil {
+		fmt.Println("Configuration not reloaded: " + err.Error())
+		return
+	}
+	fmt.Println("Configuration reloaded")
+	if len(needRestart) != 0 {
+		fmt.Println("Restart to change " + strings.Join(needRestart, ", "))
+	}
 }
 
 func VersionString() string {
-    return "IoM v"+CurrentVersion
+	return "IoM v" + CurrentVersion
 }
 
 func printDebugVersionInfo() {
 	fmt.Printf("Internet of Music v%s\nGo v%s\nCreated & maintained by ", CurrentVersion, runtime.Version()[2:])
-    fmt.Println(Maintainers)
+	fmt.Println(Maintainers)
 }
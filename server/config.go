@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EnvPrefix     = "IOM_"
+	ConfigFlag    = "config"
+	authConfigKey = "auth"
+)
+
+var (
+	// InlineAuth users & tokens written straight into the config file, used when no -auth file is given
+	InlineAuth *AuthConfig
+	// debugLogging whether -debug is on; 1 or 0, as it can change while serving
+	debugLogging int32
+	// liveSettings settings which a reload applies without a restart
+	liveSettings = map[string]bool{"quality": true, "buffer": true, "debug": true, "formats": true, authConfigKey: true}
+	// liveMu guards the flag variables of live settings, which a reload sets while rooms may be starting
+	liveMu sync.RWMutex
+)
+
+// DebugLogging whether to log debug information & serve debug endpoints
+func DebugLogging() bool {
+	return atomic.LoadInt32(&debugLogging) == 1
+}
+
+func setDebugLogging(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&debugLogging, value)
+}
+
+// envName environment variable which overrides a flag, like IOM_QUEUE_BUFFER for -queue-buffer
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// explicitFlags flags given on the command line
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// readConfigFile get the flag values & inline auth in a JSON config file.
+// Nested objects are joined with '-', so {"queue": {"buffer": 4}} sets -queue-buffer.
+func readConfigFile(fs *flag.FlagSet, filename string) (settings map[string]string, inlineAuth *AuthConfig, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err = decoder.Decode(&values); err != nil {
+		return
+	}
+	settings = map[string]string{}
+	if err = flattenConfig("", values, settings); err != nil {
+		return
+	}
+	for name := range settings {
+		if name == ConfigFlag || fs.Lookup(name) == nil {
+			return nil, nil, fmt.Errorf("UnknownSetting %q", name)
+		}
+	}
+	if raw, ok := values[authConfigKey].(map[string]interface{}); ok {
+		// users & tokens inline, rather than a path to an auth file
+		authData, _ := json.Marshal(raw)
+		var authConfig AuthConfig
+		if err = json.Unmarshal(authData, &authConfig); err == nil {
+			err = validateAuthConfig(authConfig)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", authConfigKey, err)
+		}
+		inlineAuth = &authConfig
+	}
+	return
+}
+
+// flattenConfig turn decoded JSON into flag name -> flag value
+func flattenConfig(prefix string, values map[string]interface{}, settings map[string]string) error {
+	for key, value := range values {
+		name := prefix + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if name == authConfigKey {
+				continue // handled by readConfigFile
+			}
+			if err := flattenConfig(name+"-", v, settings); err != nil {
+				return err
+			}
+		case string:
+			settings[name] = v
+		case json.Number:
+			settings[name] = v.String()
+		case bool:
+			settings[name] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("InvalidSetting %q", name)
+		}
+	}
+	return nil
+}
+
+// resolveSettings work out the value of every flag, without setting any.
+// Order, lowest to highest priority: defaults, config file, IOM_* environment variables, command line flags.
+func resolveSettings(fs *flag.FlagSet, explicit map[string]bool, lookup func(string) (string, bool)) (settings map[string]string, inlineAuth *AuthConfig, err error) {
+	settings = map[string]string{}
+	fromEnv := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = f.DefValue
+		if value, ok := lookup(envName(f.Name)); ok {
+			fromEnv[f.Name] = value
+		}
+	})
+	configPath := fromEnv[ConfigFlag]
+	if explicit[ConfigFlag] {
+		configPath = fs.Lookup(ConfigFlag).Value.String()
+	}
+	if configPath != "" {
+		var fromFile map[string]string
+		fromFile, inlineAuth, err = readConfigFile(fs, configPath)
+		if err != nil {
+			return nil, nil, errors.New("Invalid config " + configPath + ": " + err.Error())
+		}
+		for name, value := range fromFile {
+			settings[name] = value
+		}
+	}
+	for name, value := range fromEnv {
+		settings[name] = value
+	}
+	for name := range explicit {
+		settings[name] = fs.Lookup(name).Value.String()
+	}
+	if _, ok := fromEnv[authConfigKey]; ok || explicit[authConfigKey] {
+		inlineAuth = nil // an auth file was chosen instead
+	}
+	return
+}
+
+// loadConfiguration set flags from the config file & environment, leaving flags given on the command line alone.
+// Returns the flags which were given on the command line, as setting the others makes them look given too.
+func loadConfiguration(fs *flag.FlagSet, lookup func(string) (string, bool)) (explicit map[string]bool, err error) {
+	explicit = explicitFlags(fs)
+	settings, inlineAuth, err := resolveSettings(fs, explicit, lookup)
+	if err != nil {
+		return
+	}
+	for _, name := range sortedSettings(settings) {
+		if explicit[name] {
+			continue
+		}
+		if err = fs.Set(name, settings[name]); err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %s", name, settings[name], err)
+		}
+	}
+	InlineAuth = inlineAuth
+	return
+}
+
+// reloadConfiguration re-read the config file & environment, applying the settings which can change while playing.
+// Every live setting is checked before any is applied, and the players are put back as they were if one of them
+// can't change, so nothing is applied when the reload fails. Returns the other settings which changed, as they need a restart.
+func reloadConfiguration(fs *flag.FlagSet, explicit map[string]bool, lookup func(string) (string, bool)) (needRestart []string, err error) {
+	settings, inlineAuth, err := resolveSettings(fs, explicit, lookup)
+	if err != nil {
+		return
+	}
+	quality, err := strconv.Atoi(settings["quality"])
+	if err != nil || quality < 1 || quality > 64 {
+		return nil, fmt.Errorf("Invalid quality %q", settings["quality"])
+	}
+	buffer, err := time.ParseDuration(settings["buffer"])
+	if err != nil || buffer <= 0 {
+		return nil, fmt.Errorf("Invalid buffer %q", settings["buffer"])
+	}
+	debug, err := strconv.ParseBool(settings["debug"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid debug %q", settings["debug"])
+	}
+	formats, err := parseAllowedFormats(settings["formats"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid formats %q: %s", settings["formats"], err)
+	}
+	authConfig := inlineAuth
+	if path := settings[authConfigKey]; path != "" {
+		loaded, loadErr := LoadAuthConfig(path)
+		if loadErr != nil {
+			return nil, errors.New("Invalid auth config " + path + ": " + loadErr.Error())
+		}
+		authConfig = &loaded
+	}
+	// rooms created from now on start with the new settings; it's done before changing the players so none are missed
+	old := setLiveFlags(fs, settings)
+	for _, player := range allPlayers() {
+		if err = player.Reconfigure(quality, buffer); err != nil {
+			setLiveFlags(fs, old)
+			oldQuality, _ := strconv.Atoi(old["quality"])
+			oldBuffer, _ := time.ParseDuration(old["buffer"])
+			for _, changed := range allPlayers() {
+				changed.Reconfigure(oldQuality, oldBuffer)
+			}
+			return nil, err
+		}
+	}
+	setDebugLogging(debug)
+	setAllowedFormats(formats)
+	if Auth != nil && authConfig != nil {
+		Auth.SetConfig(*authConfig)
+	} else if (Auth == nil) != (authConfig == nil) {
+		needRestart = append(needRestart, authConfigKey) // requests are already being let through, or checked
+	}
+	for _, name := range sortedSettings(settings) {
+		if !liveSettings[name] && !sameSetting(fs.Lookup(name), settings[name]) {
+			needRestart = append(needRestart, name)
+		}
+	}
+	sort.Strings(needRestart)
+	return needRestart, nil
+}
+
+// setLiveFlags set the flags of the live settings, returning their previous values
+func setLiveFlags(fs *flag.FlagSet, settings map[string]string) (old map[string]string) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	old = map[string]string{}
+	for name := range liveSettings {
+		if f := fs.Lookup(name); f != nil {
+			old[name] = f.Value.String()
+			f.Value.Set(settings[name])
+		}
+	}
+	return
+}
+
+// sameSetting whether value means the same as a flag's current value, like 0.1s & 100ms
+func sameSetting(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() == value
+	}
+	switch current := getter.Get().(type) {
+	case bool:
+		parsed, err := strconv.ParseBool(value)
+		return err == nil && parsed == current
+	case int:
+		parsed, err := strconv.Atoi(value)
+		return err == nil && parsed == current
+	case int64:
+		parsed, err := strconv.ParseInt(value, 0, 64)
+		return err == nil && parsed == current
+	case time.Duration:
+		parsed, err := time.ParseDuration(value)
+		return err == nil && parsed == current
+	}
+	return f.Value.String() == value
+}
+
+func sortedSettings(settings map[string]string) []string {
+	names := []string{}
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// queueConfig queue settings for the player, from the command line & config file
+func queueConfig() QueueConfig {
+	qc := QueueConfig{
+		PersistToDisk:   QueuePersist,
+		MemBufferSize:   QueueBuffer,
+		EnableOvercache: QueueOvercache > 0,
+		OvercacheSize:   QueueOvercache,
+		LoadTimeout:     QueueTimeout,
+		SpillDir:        QueueDir,
+		SpillInMemory:   QueueStore == QueueStoreMemory,
+		SpillQuota:      QueueQuota,
+		AudioOnly:       true,
+	}
+	if !filepath.IsAbs(qc.SpillDir) {
+		qc.SpillDir = filepath.Join(RootPath, qc.SpillDir)
+	}
+	if Journal {
+		qc.JournalDir = filepath.Join(RootPath, JournalDirname)
+	}
+	return qc
+}
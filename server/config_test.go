@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFlagSet() (fs *flag.FlagSet, port *string, buffer *time.Duration, queueBuffer *int, persist *bool) {
+	fs = flag.NewFlagSet("iom", flag.ContinueOnError)
+	port = fs.String("port", DefaultPort, "")
+	buffer = fs.Duration("buffer", DefaultBuffer, "")
+	queueBuffer = fs.Int("queue-buffer", DefaultQueueBuffer, "")
+	persist = fs.Bool("queue-persist", false, "")
+	fs.String("auth", "", "")
+	fs.String(ConfigFlag, "", "")
+	return
+}
+
+func writeTestConfig(t *testing.T, config string) string {
+	file, err := ioutil.TempFile("", "iomconfig*.json")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile() raised error %s", err)
+	}
+	file.WriteString(config)
+	file.Close()
+	return file.Name()
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"port": 9000,
+		"buffer": "250ms",
+		"queue": {"buffer": 4, "persist": true},
+		"auth": {"users": [{"name": "dj", "password": "hunter2", "role": "dj"}], "anonymous": "listener"}
+	}`)
+	defer os.Remove(path)
+	defer func() { InlineAuth = nil }()
+	env := map[string]string{"IOM_PORT": "9001", "IOM_QUEUE_BUFFER": "6"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	fs, port, buffer, queueBuffer, persist := newTestFlagSet()
+	fs.Parse([]string{"-config", path, "-queue-buffer", "8"})
+	if _, err := loadConfiguration(fs, lookup); err != nil {
+		t.Fatalf("loadConfiguration() raised error %s", err)
+	}
+	// config file < environment < command line
+	if *port != "9001" || *buffer != 250*time.Millisecond || *queueBuffer != 8 || !*persist {
+		t.Errorf("Unexpected settings port=%s buffer=%s queue-buffer=%d queue-persist=%t", *port, *buffer, *queueBuffer, *persist)
+	}
+	if InlineAuth == nil || len(InlineAuth.Users) != 1 || InlineAuth.Anonymous != RoleListener {
+		t.Errorf("Expected inline auth config, got %+v", InlineAuth)
+	}
+
+	// the config file can come from the environment too
+	env = map[string]string{"IOM_CONFIG": path}
+	fs, port, _, _, _ = newTestFlagSet()
+	fs.Parse(nil)
+	if _, err := loadConfiguration(fs, lookup); err != nil || *port != "9000" {
+		t.Errorf("Expected port from IOM_CONFIG file, got %s, %v", *port, err)
+	}
+
+	env = map[string]string{}
+	for _, bad := range []string{
+		`{"colour": "blue"}`,
+		`{"queue": {"size": 1}}`,
+		`{"buffer": "soon"}`,
+		`{"port": [8080]}`,
+		`{"auth": {"users": [{"name": "nopassword"}]}}`,
+		`not json`,
+	} {
+		badPath := writeTestConfig(t, bad)
+		fs, _, _, _, _ = newTestFlagSet()
+		fs.Parse([]string{"-config", badPath})
+		if _, err := loadConfiguration(fs, lookup); err == nil {
+			t.Errorf("Expected error for config %s", bad)
+		}
+		os.Remove(badPath)
+	}
+	fs, _, _, _, _ = newTestFlagSet()
+	fs.Parse(nil)
+	if _, err := loadConfiguration(fs, func(string) (string, bool) { return "many", true }); err == nil {
+		t.Errorf("Expected error for invalid environment variable")
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	path := writeTestConfig(t, `{"quality": 2, "buffer": "20ms", "debug": true, "formats": "wav", "port": "9000", "sample": 8000}`)
+	defer os.Remove(path)
+	defer func() { PlayerInst, Auth = nil, nil; setDebugLogging(false); setAllowedFormats(nil) }()
+	noEnv := func(string) (string, bool) { return "", false }
+	fs := flag.NewFlagSet("iom", flag.ContinueOnError)
+	fs.String("port", DefaultPort, "")
+	fs.Int64("sample", DefaultSampleRate, "")
+	fs.Int("quality", 1, "")
+	fs.Duration("buffer", time.Second/100, "")
+	fs.Bool("debug", false, "")
+	fs.String("formats", DefaultFormats, "")
+	fs.String("auth", "", "")
+	fs.String(ConfigFlag, "", "")
+	fs.Parse([]string{"-config", path, "-port", "9000"})
+	explicit, err := loadConfiguration(fs, noEnv)
+	if err != nil {
+		t.Fatalf("loadConfiguration() raised error %s", err)
+	}
+	PlayerInst = newTestPlayer()
+	PlayerInst.Enqueue(generateTestTrack(time.Second))
+	PlayerInst.Play()
+	Auth = NewAuthenticator(AuthConfig{Anonymous: RoleAdmin})
+
+	// what's in the file at startup doesn't need a restart; the sample rate & auth changes do
+	ioutil.WriteFile(path, []byte(`{"quality": 3, "buffer": "0.05s", "debug": true, "formats": "flac, mp3", "port": "9001", "sample": "44100",
+		"auth": {"users": [{"name": "dj", "password": "hunter2", "role": "dj"}]}}`), 0644)
+	needRestart, err := reloadConfiguration(fs, explicit, noEnv)
+	if err != nil {
+		t.Fatalf("reloadConfiguration() raised error %s", err)
+	}
+	if !reflect.DeepEqual(needRestart, []string{"sample"}) {
+		t.Errorf("Expected only sample to need a restart, got %v", needRestart)
+	}
+	PlayerInst.Status() // wait for the player to apply it
+	if PlayerInst.Config.Quality != 3 || PlayerInst.Config.BufferedTime != time.Second/20 {
+		t.Errorf("Expected quality & buffer to change live, got %+v", PlayerInst.Config)
+	}
+	if fs.Lookup("quality").Value.String() != "3" || fs.Lookup("buffer").Value.String() != "50ms" {
+		t.Errorf("Expected the reload to set the quality & buffer rooms are created with, got %s, %s", fs.Lookup("quality").Value, fs.Lookup("buffer").Value)
+	}
+	if !DebugLogging() || checkAllowedFormat(MimeWav) == nil || checkAllowedFormat(MimeFLAC) != nil {
+		t.Errorf("Expected debug logging on & only flac, mp3 allowed")
+	}
+	if role, _ := Auth.RoleOf(httptest.NewRequest("GET", "/", nil)); role != RoleNone {
+		t.Errorf("Expected reloaded auth config to drop the anonymous role, got %s", role)
+	}
+
+	// nothing changes when a live setting is invalid
+	ioutil.WriteFile(path, []byte(`{"quality": 3, "debug": false, "formats": "midi"}`), 0644)
+	if _, err = reloadConfiguration(fs, explicit, noEnv); err == nil {
+		t.Errorf("Expected error reloading unknown format")
+	}
+	if !DebugLogging() {
+		t.Errorf("Expected debug logging to stay on after a failed reload")
+	}
+	// a player which can't change puts the others back
+	broken := NewPlayer(&unresizableSink{NewNullSink()})
+	broken.Config = PlayerInst.Config
+	broken.Init()
+	defer broken.Close()
+	setAllowedFormats(nil) // for the wav test track
+	broken.Enqueue(generateTestTrack(time.Second))
+	broken.Play()
+	Rooms = &RoomManager{rooms: map[string]*Room{"broken": {Name: "broken", Player: broken}}}
+	ioutil.WriteFile(path, []byte(`{"quality": 5, "buffer": "30ms"}`), 0644)
+	if _, err = reloadConfiguration(fs, explicit, noEnv); err == nil {
+		t.Errorf("Expected error reloading a buffer a player can't change to")
+	}
+	PlayerInst.Status()
+	if PlayerInst.Config.Quality != 3 || PlayerInst.Config.BufferedTime != time.Second/20 || fs.Lookup("quality").Value.String() != "3" {
+		t.Errorf("Expected a failed reload to leave the settings alone, got %+v, quality %s", PlayerInst.Config, fs.Lookup("quality").Value)
+	}
+	Rooms = nil
+	// turning auth off can't happen live
+	ioutil.WriteFile(path, []byte(`{"quality": 3, "buffer": "50ms", "sample": 8000}`), 0644)
+	if needRestart, _ = reloadConfiguration(fs, explicit, noEnv); !reflect.DeepEqual(needRestart, []string{"auth"}) {
+		t.Errorf("Expected auth to need a restart, got %v", needRestart)
+	}
+}
+
+// unresizableSink sink whose buffer can't change
+type unresizableSink struct {
+	*NullSink
+}
+
+func (unresizableSink) Resize(bufferSize int) error {
+	return errors.New("NotResizable")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventType kind of change to the player or queue
+type EventType string
+
+const (
+	EventTrackStarted  EventType = "track-started"
+	EventTrackEnded    EventType = "track-ended"
+	EventPaused        EventType = "paused"
+	EventResumed       EventType = "resumed"
+	EventEnqueued      EventType = "enqueued"
+	EventQueueFinished EventType = "queue-finished"
+	EventDecodeError   EventType = "decode-error"
+	EventQueueChanged  EventType = "queue-changed" // items were removed, moved or inserted
+
+	EventsHeartbeat   = 15 * time.Second // keeps idle connections from being timed out by proxies
+	eventsChannelSize = 64
+)
+
+// Event something which happened to the player or queue
+type Event struct {
+	Type  EventType  `json:"type"`
+	Time  time.Time  `json:"time"`
+	Index int        `json:"index"` // absolute queue index the event is about
+	Track *TrackInfo `json:"track,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// EventBus fan out events to every subscriber
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[chan Event]bool{}}
+}
+
+// Subscribe get a channel which receives every event published from now on.
+// Events are dropped for subscribers which fall too far behind.
+func (b *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, eventsChannelSize)
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stop sending events to ch and close it
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	if b.subscribers[ch] {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+}
+
+// Publish send an event to every subscriber without blocking; a nil EventBus discards events
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default: // subscriber is too slow
+		}
+	}
+}
+
+// eventsHandler stream player events as Server-Sent Events, or over a WebSocket when asked to upgrade
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		serveEventsWebSocket(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming is not supported")
+		return
+	}
+	events := playerOf(r).Events.Subscribe()
+	defer playerOf(r).Events.Unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// serveEventsWebSocket stream player events as JSON text messages
+func serveEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	events := playerOf(r).Events.Subscribe()
+	defer playerOf(r).Events.Unsubscribe(events)
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		fmt.Println("WebSocket upgrade failed: " + err.Error())
+		return
+	}
+	defer conn.Close()
+	closed := make(chan bool)
+	go func() {
+		// clients don't send anything useful, but control frames must be answered
+		defer close(closed)
+		for {
+			opcode, payload, readErr := conn.ReadFrame()
+			if readErr != nil {
+				return
+			}
+			switch opcode {
+			case wsOpClose:
+				conn.WriteFrame(wsOpClose, payload)
+				return
+			case wsOpPing:
+				conn.WriteFrame(wsOpPong, payload)
+			}
+		}
+	}()
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var writeErr error
+		select {
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			// the server stopping doesn't touch hijacked connections, so it's closed here: 1001 going away
+			conn.WriteFrame(wsOpClose, []byte{0x03, 0xE9})
+			return
+		case e := <-events:
+			data, jsonErr := json.Marshal(e)
+			if jsonErr != nil {
+				fmt.Println(jsonErr)
+				continue
+			}
+			writeErr = conn.WriteFrame(wsOpText, data)
+		case <-heartbeat.C:
+			writeErr = conn.WriteFrame(wsOpPing, nil)
+		}
+		if writeErr != nil {
+			return
+		}
+	}
+}
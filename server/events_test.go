@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectEvent wait for the next event and check its type
+func expectEvent(t *testing.T, events chan Event, expected EventType) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Type != expected {
+			t.Fatalf("Expected %s event, got %s (index %d)", expected, e.Type, e.Index)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for %s event", expected)
+	}
+	return Event{}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	a := bus.Subscribe()
+	b := bus.Subscribe()
+	bus.Publish(Event{Type: EventPaused, Index: 3})
+	if e := expectEvent(t, a, EventPaused); e.Index != 3 || e.Time.IsZero() {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	expectEvent(t, b, EventPaused)
+	bus.Unsubscribe(a)
+	if _, ok := <-a; ok {
+		t.Errorf("Expected channel to be closed by Unsubscribe")
+	}
+	for i := 0; i < eventsChannelSize*2; i++ {
+		bus.Publish(Event{Type: EventResumed}) // must not block on a full subscriber
+	}
+	var nilBus *EventBus
+	nilBus.Publish(Event{Type: EventResumed})
+}
+
+func TestPlayerEvents(t *testing.T) {
+	p := newTestPlayer()
+	events := p.Events.Subscribe()
+	p.Enqueue(generateTestTrack(200 * time.Millisecond))
+	p.Enqueue(generateTestTrack(200 * time.Millisecond))
+	if e := expectEvent(t, events, EventEnqueued); e.Index != 0 || e.Track == nil || e.Track.SampleRate != 8000 {
+		t.Errorf("Unexpected enqueued event %+v", e)
+	}
+	expectEvent(t, events, EventEnqueued)
+	p.Play()
+	expectEvent(t, events, EventTrackStarted)
+	p.Pause()
+	expectEvent(t, events, EventPaused)
+	p.Play()
+	expectEvent(t, events, EventResumed)
+	expectEvent(t, events, EventTrackEnded)
+	if e := expectEvent(t, events, EventTrackStarted); e.Index != 1 {
+		t.Errorf("Expected second track to start, got index %d", e.Index)
+	}
+	if e := expectEvent(t, events, EventTrackEnded); e.Index != 1 {
+		t.Errorf("Expected second track to end, got index %d", e.Index)
+	}
+	expectEvent(t, events, EventQueueFinished)
+}
+
+func newTestEventsServer() *httptest.Server {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	return httptest.NewServer(http.HandlerFunc(eventsHandler))
+}
+
+func TestEventsSSE(t *testing.T) {
+	server := newTestEventsServer()
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("http.Get() raised error %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("Unexpected first line %q", line)
+	}
+	reader.ReadString('\n')
+	PlayerInst.Events.Publish(Event{Type: EventTrackStarted, Index: 7})
+	eventLine, _ := reader.ReadString('\n')
+	dataLine, _ := reader.ReadString('\n')
+	if eventLine != "event: track-started\n" {
+		t.Errorf("Unexpected event line %q", eventLine)
+	}
+	var e Event
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &e); err != nil {
+		t.Fatalf("json.Unmarshal() raised error %s", err)
+	}
+	if e.Type != EventTrackStarted || e.Index != 7 {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
+
+func TestEventsWebSocket(t *testing.T) {
+	server := newTestEventsServer()
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("net.Dial() raised error %s", err)
+	}
+	defer conn.Close()
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	ws := &wsConn{conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	resp, err := http.ReadResponse(ws.rw.Reader, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse() raised error %s", err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+	}
+	// example from RFC 6455
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected Sec-WebSocket-Accept %q", accept)
+	}
+	PlayerInst.Events.Publish(Event{Type: EventPaused, Index: 2})
+	opcode, payload, err := ws.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame() raised error %s", err)
+	}
+	var e Event
+	json.Unmarshal(payload, &e)
+	if opcode != wsOpText || e.Type != EventPaused || e.Index != 2 {
+		t.Errorf("Unexpected frame %d %q", opcode, payload)
+	}
+	conn.Write([]byte{0x80 | wsOpClose, 0x80, 1, 2, 3, 4}) // masked, empty
+	if opcode, _, err = ws.ReadFrame(); err != nil || opcode != wsOpClose {
+		t.Errorf("Expected close frame in reply, got %d (%v)", opcode, err)
+	}
+}
+
+func TestEventsWebSocketBadHandshake(t *testing.T) {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	rec := httptest.NewRecorder()
+	eventsHandler(rec, r)
+	if rec.Code != 400 {
+		t.Errorf("Expected status 400 without a key, got %d", rec.Code)
+	}
+}
+
+func TestEventsWebSocketOrigin(t *testing.T) {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	defer func() { allowedOrigins = nil }()
+	allowedOrigins = parseOrigins(" https://Friends.example/, ")
+	// a recorder can't be taken over, so handshakes which get past the origin check fail with 500
+	for origin, expected := range map[string]int{
+		"":                        500,
+		"http://example.com":      500,
+		"https://friends.example": 500,
+		"https://evil.example":    403,
+		"null":                    403,
+	} {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		eventsHandler(rec, r)
+		if rec.Code != expected {
+			t.Errorf("Expected status %d for origin %q, got %d", expected, origin, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
+)
+
+const (
+	crossfadeStep = 512 // samples per crossfade gain adjustment
+)
+
+// track decoded queue item, resampled to the output sample rate
+type track struct {
+	source   beep.StreamSeekCloser
+	format   beep.Format
+	streamer beep.Streamer
+	quality  int
+	rate     beep.SampleRate
+	length   int // in output samples
+	played   int // in output samples; the resampler reads ahead so source.Position() runs early
+}
+
+func newTrack(f ReadSeekerCloser, sampleRate beep.SampleRate, quality int) (*track, error) {
+	source, format, err := decodeAudioFile(borrowedFile{f})
+	if err != nil {
+		return nil, err
+	}
+	t := &track{
+		source:  source,
+		format:  format,
+		quality: quality,
+		rate:    sampleRate,
+		length:  sampleRate.N(format.SampleRate.D(source.Len())),
+	}
+	t.streamer = beep.Resample(quality, format.SampleRate, sampleRate, source)
+	return t, nil
+}
+
+// close release the decoder once the track is dropped; the queue item it was decoded from stays open
+func (t *track) close() {
+	if t != nil {
+		t.source.Close()
+	}
+}
+
+// borrowedFile queue item lent to a decoder. The queue owns it and may decode it again (to repeat it, say),
+// so closing it does nothing.
+type borrowedFile struct {
+	ReadSeekerCloser
+}
+
+func (borrowedFile) Close() error {
+	return nil
+}
+
+func (t *track) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = t.streamer.Stream(samples)
+	t.played += n
+	return
+}
+
+func (t *track) Err() error {
+	return t.streamer.Err()
+}
+
+// remaining samples, at the output sample rate, until the track ends
+func (t *track) remaining() int {
+	return t.length - t.played
+}
+
+// position playback position within the track
+func (t *track) position() time.Duration {
+	return t.rate.D(t.played)
+}
+
+// seek move to position, discarding anything the resampler has buffered
+func (t *track) seek(position time.Duration) error {
+	sample := t.format.SampleRate.N(position)
+	if sample < 0 || sample > t.source.Len() {
+		return errors.New("PositionOutOfRange")
+	}
+	err := t.source.Seek(sample)
+	if err != nil {
+		return err
+	}
+	t.streamer = beep.Resample(t.quality, t.format.SampleRate, t.rate, t.source)
+	t.played = t.rate.N(position)
+	return nil
+}
+
+// trackStreamer streams the current track then moves straight on to the pre-decoded next track,
+// crossfading between the two when fade is set. It never drains; it streams silence when there is
+// no current track. Fields must only be accessed while the sink is locked.
+type trackStreamer struct {
+	current  *track
+	next     *track
+	fade     int  // crossfade length, in samples
+	switched int  // moves onto the next track which the player hasn't handled yet
+	ended    bool // the current track ran out with no next track to move on to
+	wake     chan bool
+	fadeOut  effects.Gain
+	fadeIn   effects.Gain
+}
+
+func newTrackStreamer(fade int) *trackStreamer {
+	return &trackStreamer{
+		fade: fade,
+		wake: make(chan bool, 1),
+	}
+}
+
+func (ts *trackStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) {
+		if ts.current == nil {
+			for i := range samples[n:] {
+				samples[n+i] = [2]float64{}
+			}
+			return len(samples), true
+		}
+		isFading := ts.next != nil && ts.fade > 0
+		remaining := ts.current.remaining()
+		if isFading && remaining <= ts.fade {
+			n += ts.crossfade(samples[n:], remaining)
+			continue
+		}
+		chunk := samples[n:]
+		if isFading && len(chunk) > remaining-ts.fade {
+			// stop where the crossfade begins
+			chunk = chunk[:remaining-ts.fade]
+		}
+		sn, sok := ts.current.Stream(chunk)
+		n += sn
+		if !sok || sn == 0 {
+			ts.advance()
+		}
+	}
+	return n, true
+}
+
+func (ts *trackStreamer) Err() error {
+	return nil
+}
+
+// crossfade mix the end of the current track with the start of the next track
+func (ts *trackStreamer) crossfade(samples [][2]float64, remaining int) int {
+	if len(samples) > crossfadeStep {
+		samples = samples[:crossfadeStep]
+	}
+	progress := 1 - float64(remaining)/float64(ts.fade)
+	ts.fadeOut.Streamer = ts.current
+	ts.fadeOut.Gain = -progress // Gain scales by 1 + Gain
+	ts.fadeIn.Streamer = ts.next
+	ts.fadeIn.Gain = progress - 1
+	sn, _ := beep.Mix(&ts.fadeOut, &ts.fadeIn).Stream(samples)
+	if sn < len(samples) || ts.current.remaining() <= 0 {
+		ts.advance()
+	}
+	return len(samples)
+}
+
+// advance move on to the next track and let the player know
+func (ts *trackStreamer) advance() {
+	ts.current.close()
+	ts.current = ts.next
+	ts.next = nil
+	if ts.current != nil {
+		ts.switched++
+	} else {
+		ts.ended = true
+	}
+	ts.notify()
+}
+
+func (ts *trackStreamer) notify() {
+	select {
+	case ts.wake <- true:
+	default: // player already has a pending wake up
+	}
+}
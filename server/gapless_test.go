@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/wav"
+)
+
+// newToneTrack decode a WAV of length samples which all have the given value
+func newToneTrack(t *testing.T, value float64, length int) *track {
+	defer os.Remove(testWavFile)
+	f, err := os.Create(testWavFile)
+	if err != nil {
+		t.Fatalf("os.Create() raised error %s", err)
+	}
+	remaining := length
+	tone := beep.StreamerFunc(func(samples [][2]float64) (n int, ok bool) {
+		for n < len(samples) && remaining > 0 {
+			samples[n] = [2]float64{value, value}
+			n++
+			remaining--
+		}
+		return n, n > 0
+	})
+	wav.Encode(f, tone, testTrackFormat)
+	f.Close()
+	data, _ := ioutil.ReadFile(testWavFile)
+	tr, err := newTrack(NewWrapCloser(bytes.NewReader(data)), testTrackFormat.SampleRate, 1)
+	if err != nil {
+		t.Fatalf("newTrack() raised error %s", err)
+	}
+	return tr
+}
+
+func streamAll(s beep.Streamer, length int) [][2]float64 {
+	samples := make([][2]float64, length)
+	for i := 0; i < length; i += 100 {
+		end := i + 100
+		if end > length {
+			end = length
+		}
+		s.Stream(samples[i:end])
+	}
+	return samples
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.01
+}
+
+func TestGaplessTransition(t *testing.T) {
+	ts := newTrackStreamer(0)
+	ts.current = newToneTrack(t, 0.5, 1000)
+	ts.next = newToneTrack(t, 0.25, 1000)
+	samples := streamAll(ts, 2500)
+	for i := 10; i < 1990; i++ { // resampling smooths the very start & end
+		if near(samples[i][0], 0) {
+			t.Fatalf("Unexpected silence at sample %d", i)
+		}
+	}
+	if !near(samples[500][0], 0.5) || !near(samples[1500][0], 0.25) {
+		t.Errorf("Unexpected samples %v & %v", samples[500], samples[1500])
+	}
+	if !near(samples[2200][0], 0) {
+		t.Errorf("Expected silence after both tracks, got %v", samples[2200])
+	}
+	if ts.switched != 1 || !ts.ended {
+		t.Errorf("Expected 1 switch & end, got %d & %t", ts.switched, ts.ended)
+	}
+}
+
+func TestCrossfadeTransition(t *testing.T) {
+	ts := newTrackStreamer(400)
+	ts.current = newToneTrack(t, 0.5, 1000)
+	ts.next = newToneTrack(t, 0.25, 1000)
+	samples := streamAll(ts, 2500)
+	if !near(samples[300][0], 0.5) {
+		t.Errorf("Expected current track before the crossfade, got %v", samples[300])
+	}
+	mid := samples[800][0] // halfway through the crossfade
+	if mid <= 0.25 || mid >= 0.5 {
+		t.Errorf("Expected a mix of both tracks, got %v", samples[800])
+	}
+	if !near(samples[1300][0], 0.25) {
+		t.Errorf("Expected next track after the crossfade, got %v", samples[1300])
+	}
+	if !near(samples[1700][0], 0) {
+		t.Errorf("Expected the tracks to overlap by the crossfade length, got %v", samples[1700])
+	}
+	if ts.switched != 1 || !ts.ended {
+		t.Errorf("Expected 1 switch & end, got %d & %t", ts.switched, ts.ended)
+	}
+}
@@ -3,31 +3,44 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	maxFormValue = 1024 // longest form value read alongside uploaded music
+)
+
 var (
 	Requests int64 = 0
 )
 
 func handleChores(w http.ResponseWriter, r *http.Request) {
-	Requests++
+	atomic.AddInt64(&Requests, 1)
 }
 
 func debugHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Debug Handler called")
 	handleChores(w, r)
-	fmt.Fprintf(w, "Go version: %s\nRequests: %d\nUptime: %s", runtime.Version(), Requests, time.Since(StartTime).String())
+	fmt.Fprintf(w, "Go version: %s\nRequests: %d\nUptime: %s", runtime.Version(), atomic.LoadInt64(&Requests), time.Since(StartTime).String())
 }
 
 func htmlHandler(w http.ResponseWriter, r *http.Request) {
-	if Debug {
+	if DebugLogging() {
 		fmt.Println("HTML Handler called")
 	}
 	handleChores(w, r)
@@ -39,80 +52,445 @@ func htmlHandler(w http.ResponseWriter, r *http.Request) {
 		urlPath = "index.html"
 	}
 	if urlPath[len(urlPath)-5:] != ".html" {
-		w.WriteHeader(400)
 		fmt.Printf("400 error while loading %s\n", urlPath)
-		fmt.Fprintf(w, "HTTP 400: Cannot access non-HTML resource %s\n", urlPath)
+		writeError(w, 400, fmt.Sprintf("Cannot access non-HTML resource %s", urlPath))
 		return
 	}
 	file, err := os.Open(filepath.Join(RootPath, "html", urlPath))
 	if err != nil {
-		w.WriteHeader(404)
 		fmt.Printf("404 error while loading %s :: %s\n", filepath.Join(RootPath, "html", urlPath), err)
-		fmt.Fprintf(w, "HTTP 404: Unable to find HTML resource %s\n%s\n", filepath.Join("html", urlPath), err)
+		writeError(w, 404, fmt.Sprintf("Unable to find HTML resource %s", filepath.Join("html", urlPath)))
 		return
 	}
 	io.Copy(w, file)
 }
 
 func musicHandler(w http.ResponseWriter, r *http.Request) {
-	if Debug {
+	if DebugLogging() {
 		fmt.Println("Music Handler called")
 	}
 	handleChores(w, r)
-	if r.Method != "POST" {
-		w.WriteHeader(405)
-		fmt.Fprintf(w, "HTTP 405: Only POST operations are allowed to /music\n")
+	if !allowMethods(w, r, "POST") {
 		fmt.Println("Non-POST request ignored")
 		return
 	}
-	isForm := r.ParseMultipartForm(MaxMemory) == nil
-	if isForm {
-		fmt.Println("Handling form-encoded files")
-		// handle form files
-		for key := range r.MultipartForm.File {
-			file, _, err := r.FormFile(key)
-			if err == nil {
-				fmt.Println("Queuing new file")
-				PlayerInst.Enqueue(file)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		fmt.Println("Handling JSON-encoded files")
+		handleMusicJSON(w, r)
+		return
+	}
+	if mediaType != "multipart/form-data" {
+		writeError(w, 400, "Music must be submitted as multipart/form-data or application/json")
+		return
+	}
+	fmt.Println("Handling form-encoded files")
+	// each file is streamed to the upload store as it arrives, instead of being parsed into memory
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, 400, "Invalid form: "+err.Error())
+		return
+	}
+	items := []musicItem{}
+	playNext := false
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		} else if partErr != nil {
+			writeError(w, 400, "Invalid form: "+partErr.Error())
+			return
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "next" {
+				value, _ := ioutil.ReadAll(io.LimitReader(part, maxFormValue))
+				playNext = string(value) == "true"
 			}
+			continue
 		}
-	} else {
-		fmt.Println("(NOT) Handling JSON-encoded files")
-		w.WriteHeader(400)
-		fmt.Fprintf(w, "HTTP 400: Only form-encoded music is currently supported")
-		// TODO: handle json files
+		item, uploadErr := newUploadItem(part.FileName(), part)
+		if !writeUploadError(w, part.FileName(), uploadErr) {
+			return
+		}
+		items = append(items, item)
+	}
+	body, queueErr := queueMusic(playerOf(r), items, playNext)
+	if queueErr != nil {
+		writeError(w, 500, queueErr.Error())
+		return
+	}
+	if accept, _, _ := mime.ParseMediaType(r.Header.Get("Accept")); accept == "application/json" {
+		writeJSON(w, 200, body)
 		return
 	}
 	w.WriteHeader(204)
 }
 
+// musicSubmission JSON body accepted by /music
+type musicSubmission struct {
+	Files []musicSubmissionFile `json:"files"` // base64-encoded audio
+	Paths []string              `json:"paths"` // files under RootPath
+	Next  bool                  `json:"next"`  // play straight after the current item, instead of at the end
+}
+
+type musicSubmissionFile struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+type musicQueued struct {
+	Name          string `json:"name"`
+	Index         int    `json:"index"`
+	SHA256        string `json:"sha256,omitempty"`         // of an upload's contents
+	AlreadyQueued []int  `json:"already_queued,omitempty"` // indexes of queue items which were already the same file
+}
+
+// musicItem a file submitted to /music, ready to be queued
+type musicItem struct {
+	name string
+	file ReadSeekerCloser // queued from memory, when there's no upload store
+	path string           // queued from disk otherwise
+	hash string
+}
+
+// newUploadItem keep an uploaded file in the upload store, or in memory when there isn't one, checking it can be played
+func newUploadItem(name string, r io.Reader) (musicItem, error) {
+	if Uploads == nil {
+		data, err := ioutil.ReadAll(io.LimitReader(r, MaxMemory+1))
+		if err != nil {
+			return musicItem{}, err
+		}
+		if int64(len(data)) > MaxMemory {
+			return musicItem{}, errors.New("FileTooLarge")
+		}
+		file := NewWrapCloser(bytes.NewReader(data))
+		_, err = probeAllowedFormat(file)
+		return musicItem{name: name, file: file}, err
+	}
+	hash, filename, err := Uploads.Put(r)
+	if err != nil {
+		return musicItem{}, err
+	}
+	stored, err := os.Open(filename)
+	if err != nil {
+		return musicItem{}, err
+	}
+	defer stored.Close()
+	_, err = probeAllowedFormat(stored) // only reads the header
+	return musicItem{name: name, path: filename, hash: hash}, err
+}
+
+// writeUploadError respond with why an upload couldn't be kept, returning true when there was no error
+func writeUploadError(w http.ResponseWriter, name string, err error) bool {
+	if err == nil {
+		return true
+	}
+	switch e := err.(type) {
+	case *UnsupportedFormatError:
+		rejectUnsupported(w, name, e)
+	default:
+		if err.Error() == "FileTooLarge" {
+			writeError(w, 413, fmt.Sprintf("%q is larger than %d bytes", name, MaxMemory))
+		} else {
+			writeError(w, 500, fmt.Sprintf("Failed to store %q: %s", name, err))
+		}
+	}
+	return false
+}
+
+// queueMusic queue every item, at the end or to play next, noting which were already in the queue
+func queueMusic(player *Player, items []musicItem, next bool) (body musicQueuedBody, err error) {
+	queuedPaths := map[string][]int{}
+	for _, entry := range player.Entries() {
+		if entry.Meta.Path != "" {
+			queuedPaths[entry.Meta.Path] = append(queuedPaths[entry.Meta.Path], entry.Index)
+		}
+	}
+	body.Queued = make([]musicQueued, len(items))
+	for n := range items {
+		i := n
+		if next {
+			i = len(items) - 1 - n // queued in reverse so they're played in the order submitted
+		}
+		item := items[i]
+		fmt.Println("Queuing new file " + item.name)
+		var index int
+		switch {
+		case item.path == "" && next:
+			index, err = player.EnqueueNext(item.file)
+		case item.path == "":
+			index, err = player.Enqueue(item.file)
+		case next:
+			index, err = player.EnqueueFileNext(item.path)
+		default:
+			index, err = player.EnqueueFile(item.path)
+		}
+		if err != nil {
+			err = fmt.Errorf("Failed to queue %q: %s", item.name, err)
+			return
+		}
+		body.Queued[i] = musicQueued{Name: item.name, Index: index, SHA256: item.hash, AlreadyQueued: append([]int(nil), queuedPaths[item.path]...)}
+	}
+	if next {
+		current := player.Status().Index
+		for i := range body.Queued {
+			// later inserts pushed the earlier ones along, and the items after the current one too
+			body.Queued[i].Index = body.Queued[0].Index + i
+			for j, index := range body.Queued[i].AlreadyQueued {
+				if index > current {
+					body.Queued[i].AlreadyQueued[j] += len(items)
+				}
+			}
+		}
+	}
+	return
+}
+
+type musicQueuedBody struct {
+	Queued []musicQueued `json:"queued"`
+}
+
+func handleMusicJSON(w http.ResponseWriter, r *http.Request) {
+	var submission musicSubmission
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxMemory))
+	decodeErr := decoder.Decode(&submission)
+	if decodeErr != nil {
+		writeError(w, 400, "Invalid JSON body: "+decodeErr.Error())
+		return
+	}
+	// load everything before queueing so a bad item doesn't leave a partial submission
+	files := []musicItem{}
+	for i, sf := range submission.Files {
+		data, err := base64.StdEncoding.DecodeString(sf.Data)
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("Invalid base64 data for file %d: %s", i, err))
+			return
+		}
+		name := sf.Name
+		if name == "" {
+			name = "file" + strconv.Itoa(i)
+		}
+		item, uploadErr := newUploadItem(name, bytes.NewReader(data))
+		if !writeUploadError(w, name, uploadErr) {
+			return
+		}
+		files = append(files, item)
+	}
+	items := []musicItem{}
+	for _, path := range submission.Paths {
+		fullPath, err := resolveRootPath(path)
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("Invalid path %q: %s", path, err))
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || info.IsDir() {
+			writeError(w, 404, fmt.Sprintf("Unable to open %q", path))
+			return
+		}
+		file, err := os.Open(fullPath)
+		if err != nil {
+			writeError(w, 404, fmt.Sprintf("Unable to open %q", path))
+			return
+		}
+		_, probeErr := probeAllowedFormat(file)
+		file.Close()
+		if probeErr != nil {
+			rejectUnsupported(w, path, probeErr)
+			return
+		}
+		absPath, err := filepath.Abs(fullPath)
+		if err != nil {
+			writeError(w, 404, fmt.Sprintf("Unable to open %q", path))
+			return
+		}
+		items = append(items, musicItem{name: path, path: absPath})
+	}
+	if len(files) == 0 && len(items) == 0 {
+		writeError(w, 400, "No files or paths submitted")
+		return
+	}
+	// files then paths
+	body, err := queueMusic(playerOf(r), append(files, items...), submission.Next)
+	if err != nil {
+		writeError(w, 500, err.Error())
+		return
+	}
+	writeJSON(w, 200, body)
+}
+
+// rejectUnsupported respond to a submission containing a file which can't be played
+func rejectUnsupported(w http.ResponseWriter, name string, err error) {
+	fmt.Printf("Rejected %s :: %s\n", name, err)
+	if _, ok := err.(*UnsupportedFormatError); ok {
+		writeError(w, 415, fmt.Sprintf("Unsupported audio in %q: %s", name, err))
+	} else {
+		writeError(w, 400, fmt.Sprintf("Unable to read %q: %s", name, err))
+	}
+}
+
+// resolveRootPath translate a client-supplied path to a file path which must be inside RootPath
+func resolveRootPath(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("EmptyPath")
+	}
+	fullPath := filepath.Join(RootPath, filepath.FromSlash(path))
+	rel, err := filepath.Rel(RootPath, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("PathOutsideRoot")
+	}
+	return fullPath, nil
+}
+
 func playHandler(w http.ResponseWriter, r *http.Request) {
 	handleChores(w, r)
-	PlayerInst.Play()
+	playerOf(r).Play()
 	w.WriteHeader(204)
 }
 
 func pauseHandler(w http.ResponseWriter, r *http.Request) {
 	handleChores(w, r)
-	PlayerInst.Pause()
+	playerOf(r).Pause()
 	w.WriteHeader(204)
 }
 
 func nextHandler(w http.ResponseWriter, r *http.Request) {
 	handleChores(w, r)
-	PlayerInst.Next()
+	playerOf(r).Next()
 	w.WriteHeader(204)
 }
 
 func previousHandler(w http.ResponseWriter, r *http.Request) {
 	handleChores(w, r)
-	PlayerInst.Previous()
+	playerOf(r).Previous()
 	w.WriteHeader(204)
 }
 
+type positionBody struct {
+	Position float64 `json:"position"` // seconds
+	Length   float64 `json:"length"`   // seconds
+}
+
+func positionHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	writePosition(w, playerOf(r))
+}
+
+func writePosition(w http.ResponseWriter, player *Player) {
+	position, err := player.Position()
+	if err != nil {
+		writeError(w, 409, err.Error())
+		return
+	}
+	length, _ := player.Length()
+	writeJSON(w, 200, positionBody{Position: position.Seconds(), Length: length.Seconds()})
+}
+
+func seekHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	to := r.FormValue("to")
+	position, err := parseSeconds(to)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Invalid seek position %q", to))
+		return
+	}
+	err = playerOf(r).Seek(position)
+	if err != nil {
+		status := 409
+		if err.Error() == "PositionOutOfRange" {
+			status = 400
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writePosition(w, playerOf(r))
+}
+
+// parseSeconds parse a duration such as 1m30s, or a plain number of seconds
+func parseSeconds(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+type volumeBody struct {
+	Volume int  `json:"volume"`
+	Muted  bool `json:"muted"`
+}
+
+func volumeHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		if levelStr := r.FormValue("level"); levelStr != "" {
+			level, err := strconv.Atoi(levelStr)
+			if err == nil {
+				err = playerOf(r).SetVolume(level)
+			}
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("Invalid volume level %q", levelStr))
+				return
+			}
+		}
+		if mutedStr := r.FormValue("muted"); mutedStr != "" {
+			muted, err := strconv.ParseBool(mutedStr)
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("Invalid muted value %q", mutedStr))
+				return
+			}
+			if muted {
+				playerOf(r).Mute()
+			} else {
+				playerOf(r).Unmute()
+			}
+		}
+	}
+	level, muted := playerOf(r).Volume()
+	writeJSON(w, 200, volumeBody{Volume: level, Muted: muted})
+}
+
+type modeBody struct {
+	Shuffle bool       `json:"shuffle"`
+	Repeat  RepeatMode `json:"repeat"`
+}
+
+func modeHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		if shuffleStr := r.FormValue("shuffle"); shuffleStr != "" {
+			shuffle, err := strconv.ParseBool(shuffleStr)
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("Invalid shuffle value %q", shuffleStr))
+				return
+			}
+			playerOf(r).SetShuffle(shuffle)
+		}
+		if repeatStr := r.FormValue("repeat"); repeatStr != "" {
+			repeat, err := ParseRepeatMode(repeatStr)
+			if err != nil {
+				writeError(w, 400, fmt.Sprintf("Invalid repeat mode %q; use off, one or all", repeatStr))
+				return
+			}
+			playerOf(r).SetRepeat(repeat)
+		}
+	}
+	shuffle, repeat := playerOf(r).PlayMode()
+	writeJSON(w, 200, modeBody{Shuffle: shuffle, Repeat: repeat})
+}
+
 func exitHandler(w http.ResponseWriter, r *http.Request) {
 	handleChores(w, r)
 	w.WriteHeader(204)
 	fmt.Println("Received terminate HTTP request")
-	Exit()
+	go Exit() // Shutdown waits for this request to finish
 }
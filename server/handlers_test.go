@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func doMusicJSON(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/music", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	musicHandler(rec, req)
+	return rec
+}
+
+func TestMusicJSONSubmission(t *testing.T) {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	oldRoot, oldMaxMemory := RootPath, MaxMemory
+	defer func() { RootPath, MaxMemory = oldRoot, oldMaxMemory }()
+	MaxMemory = DefaultMaxMemory
+	RootPath, _ = ioutil.TempDir("", "iom")
+	defer os.RemoveAll(RootPath)
+	track, _ := ioutil.ReadAll(generateTestTrack(time.Second))
+	ioutil.WriteFile(filepath.Join(RootPath, "song.wav"), track, 0644)
+	ioutil.WriteFile(filepath.Join(RootPath, "song.txt"), []byte("not really a song"), 0644)
+	encoded := base64.StdEncoding.EncodeToString(track)
+
+	rec := doMusicJSON(`{"files": [{"name": "a", "data": "` + encoded + `"}], "paths": ["song.wav"]}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body musicQueuedBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json.Unmarshal() raised error %s", err)
+	}
+	if len(body.Queued) != 2 || body.Queued[0].Index != 0 || body.Queued[1].Index != 1 || body.Queued[1].Name != "song.wav" {
+		t.Fatalf("Unexpected queued response %+v", body)
+	}
+
+	bad := []string{
+		`{"paths": ["../escape.txt"]}`,
+		`{"files": [{"data": "!!!"}]}`,
+		`{}`,
+		`not json`,
+	}
+	for _, b := range bad {
+		if rec := doMusicJSON(b); rec.Code != 400 {
+			t.Errorf("Expected status 400 for %s, got %d", b, rec.Code)
+		}
+	}
+	if rec := doMusicJSON(`{"paths": ["missing.txt"]}`); rec.Code != 404 {
+		t.Errorf("Expected status 404 for missing file, got %d", rec.Code)
+	}
+	unsupported := []string{
+		`{"paths": ["song.txt"]}`,
+		`{"files": [{"data": "aGVsbG8="}]}`,
+		`{"files": [{"data": ""}]}`,
+	}
+	for _, b := range unsupported {
+		if rec := doMusicJSON(b); rec.Code != 415 {
+			t.Errorf("Expected status 415 for %s, got %d", b, rec.Code)
+		}
+	}
+	if PlayerInst.Status().MaximumIndex != 2 {
+		t.Errorf("Rejected submissions were queued")
+	}
+}
+
+func TestModeHandler(t *testing.T) {
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	rec := httptest.NewRecorder()
+	modeHandler(rec, httptest.NewRequest("POST", "/mode?shuffle=true&repeat=all", nil))
+	var body modeBody
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != 200 || !body.Shuffle || body.Repeat != RepeatAll {
+		t.Errorf("Unexpected mode response %d %+v", rec.Code, body)
+	}
+	for _, query := range []string{"shuffle=maybe", "repeat=forever"} {
+		rec = httptest.NewRecorder()
+		modeHandler(rec, httptest.NewRequest("POST", "/mode?"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("Expected status 400 for %s, got %d", query, rec.Code)
+		}
+	}
+}
+
+// TestHandlersConcurrent hammer every control endpoint at once while tracks end by themselves;
+// run with -race to check the player and queue are synchronised properly
+func TestHandlersConcurrent(t *testing.T) {
+	PlayerInst = newTestPlayer()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	track, _ := ioutil.ReadAll(generateTestTrack(30 * time.Millisecond))
+	submission := `{"files": [{"name": "a", "data": "` + base64.StdEncoding.EncodeToString(track) + `"}]}`
+	requests := []struct {
+		method, path, body string
+	}{
+		{"POST", "/music", submission},
+		{"POST", "/play", ""},
+		{"POST", "/pause", ""},
+		{"POST", "/next", ""},
+		{"POST", "/previous", ""},
+		{"POST", "/seek?to=0", ""},
+		{"GET", "/position", ""},
+		{"POST", "/volume?level=40&muted=false", ""},
+		{"POST", "/mode?shuffle=true&repeat=all", ""},
+		{"POST", "/mode?shuffle=false&repeat=off", ""},
+		{"GET", APIPrefix + "status", ""},
+		{"GET", APIPrefix + "queue", ""},
+		{"DELETE", APIPrefix + "queue/0", ""},
+		{"POST", APIPrefix + "queue/1/move?to=0", ""},
+		{"POST", "/music", `{"files": [{"data": "` + base64.StdEncoding.EncodeToString(track) + `"}], "next": true}`},
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 60; i++ {
+				req := requests[(worker*7+i)%len(requests)]
+				httpReq := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+				if req.body != "" {
+					httpReq.Header.Set("Content-Type", "application/json")
+				}
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, httpReq)
+				if rec.Code >= 500 {
+					t.Errorf("%s %s: unexpected status %d %s", req.method, req.path, rec.Code, rec.Body)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	status := PlayerInst.Status()
+	if status.Index != -1 && (status.Index < status.MinimumIndex || status.Index >= status.MaximumIndex) {
+		t.Errorf("Current index %d outside of queue %d to %d", status.Index, status.MinimumIndex, status.MaximumIndex)
+	}
+	// the player must still work afterwards
+	PlayerInst.SetRepeat(RepeatOff)
+	PlayerInst.Play()
+	PlayerInst.Enqueue(generateTestTrack(10 * time.Second))
+	PlayerInst.Play()
+	if !waitFor(2*time.Second, func() bool { s := PlayerInst.Status(); return s.Playing && !s.Paused }) {
+		t.Errorf("Player stopped responding: %+v", PlayerInst.Status())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	JournalFilename  = "queue.json"
+	JournalBlobStart = "track"
+	JournalBlobEnd   = ".file"
+)
+
+// queueJournal on-disk record of a RollingQueue, enough to rebuild it after a restart
+type queueJournal struct {
+	CurrentIndex int            `json:"current_index"`
+	Tracks       []journalTrack `json:"tracks"`
+}
+
+type journalTrack struct {
+	Index int       `json:"index"`
+	Path  string    `json:"path,omitempty"` // file appended by path, which is left where it is
+	Blob  string    `json:"blob,omitempty"` // copy of appended data, inside the journal directory
+	Meta  TrackMeta `json:"meta"`
+}
+
+func (rq *RollingQueue) isJournaled() bool {
+	return rq.config.JournalDir != ""
+}
+
+func (rq *RollingQueue) journalBlobName(index int) string {
+	return JournalBlobStart + strconv.Itoa(index) + JournalBlobEnd
+}
+
+// journalAppend record a newly appended item, copying its data unless it can be re-opened by path
+func (rq *RollingQueue) journalAppend(index int, file ReadSeekerCloser, path string) error {
+	if !rq.isJournaled() {
+		return nil
+	}
+	entry := journalTrack{Index: index, Path: path}
+	if path == "" {
+		entry.Blob = rq.journalBlobName(index)
+		file.Seek(0, 0)
+		err := writeReaderAtomic(filepath.Join(rq.config.JournalDir, entry.Blob), file)
+		file.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+	}
+	rq.journalTracks = append(rq.journalTracks, entry)
+	return nil
+}
+
+// journalDrop forget an item which is no longer retrievable
+func (rq *RollingQueue) journalDrop(index int) {
+	if !rq.isJournaled() {
+		return
+	}
+	for i, entry := range rq.journalTracks {
+		if entry.Index == index {
+			if entry.Blob != "" {
+				os.Remove(filepath.Join(rq.config.JournalDir, entry.Blob))
+			}
+			rq.journalTracks = append(rq.journalTracks[:i], rq.journalTracks[i+1:]...)
+			return
+		}
+	}
+}
+
+// journalSave write the journal to disk, replacing the previous one
+func (rq *RollingQueue) journalSave() error {
+	if !rq.isJournaled() || rq.isRestoring {
+		return nil
+	}
+	journal := queueJournal{
+		CurrentIndex: rq.currentIndex,
+		Tracks:       rq.journalTracks,
+	}
+	for i := range journal.Tracks {
+		if journal.Tracks[i].Index < len(rq.meta) {
+			journal.Tracks[i].Meta = rq.meta[journal.Tracks[i].Index]
+		}
+	}
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(rq.config.JournalDir, JournalFilename), data)
+}
+
+// journalRestore rebuild the queue from the journal, if there is one.
+// Items are renumbered from 0 and any which can no longer be opened are skipped.
+func (rq *RollingQueue) journalRestore() error {
+	if !rq.isJournaled() {
+		return nil
+	}
+	err := os.MkdirAll(rq.config.JournalDir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rq.config.JournalDir, JournalFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var journal queueJournal
+	err = json.Unmarshal(data, &journal)
+	if err != nil {
+		return err
+	}
+	current := -1
+	var missing error
+	rq.isRestoring = true
+	defer func() { rq.isRestoring = false }()
+	for _, entry := range journal.Tracks {
+		blobPath := filepath.Join(rq.config.JournalDir, entry.Blob)
+		openPath := blobPath
+		if entry.Path != "" {
+			openPath = entry.Path
+		}
+		var file *os.File
+		file, err = os.Open(openPath)
+		if err != nil {
+			missing = errors.New("MissingJournalTrack")
+			continue
+		}
+		meta, metaErr := rq.readItemMeta(file) // cover art isn't journaled, so read tags again
+		if metaErr != nil {
+			file.Close()
+			missing = metaErr
+			continue
+		}
+		if entry.Index <= journal.CurrentIndex {
+			current = rq.maximumIndex
+		}
+		meta.Added = entry.Meta.Added
+		_, err = rq.appendWithMeta(file, entry.Path, meta)
+		if err != nil {
+			return err
+		}
+		if entry.Blob != "" && entry.Blob != rq.journalBlobName(rq.maximumIndex-1) {
+			// renumbered, so the data now lives in a new blob
+			os.Remove(blobPath)
+		}
+	}
+	for rq.currentIndex < current {
+		if _, ok := rq.nextIndex(); !ok {
+			break
+		}
+		_, err = rq.next()
+		if err != nil {
+			return err
+		}
+	}
+	rq.isRestoring = false
+	err = rq.journalSave()
+	if err != nil {
+		return err
+	}
+	return missing
+}
+
+// writeFileAtomic write data to a temporary file then rename it over filename,
+// so a crash never leaves a partially written file behind
+func writeFileAtomic(filename string, data []byte) error {
+	return writeReaderAtomic(filename, bytes.NewReader(data))
+}
+
+// writeReaderAtomic write everything read from r to filename, like writeFileAtomic
+func writeReaderAtomic(filename string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LibraryPrefix       = "/library"
+	DefaultLibraryLimit = 100
+	MaxLibraryLimit     = 1000
+)
+
+// LibraryTrack audio file found on the server's disk
+type LibraryTrack struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"` // library directory's name & path within it, slash separated
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Info     TrackInfo `json:"info"`
+	fullPath string
+}
+
+// Library index of the audio files in some directories, which can be searched & queued by path
+type Library struct {
+	mu         sync.RWMutex
+	dirs       []string
+	dirNames   []string                 // first part of the paths of tracks in each directory
+	tracks     map[string]*LibraryTrack // by ID
+	sorted     []*LibraryTrack          // by Path
+	byPath     map[string]*LibraryTrack
+	isScanning bool
+	scannedAt  time.Time
+	scanErr    error
+}
+
+func NewLibrary(dirs []string) *Library {
+	return &Library{
+		dirs:     dirs,
+		dirNames: libraryDirNames(dirs),
+		tracks:   map[string]*LibraryTrack{},
+		byPath:   map[string]*LibraryTrack{},
+	}
+}
+
+// libraryDirNames name each directory after its base name, followed by the ID of its full path
+// when another directory has the same base name (like /a/music & /b/music), so their tracks' paths don't collide
+func libraryDirNames(dirs []string) []string {
+	count := map[string]int{}
+	for _, dir := range dirs {
+		count[filepath.Base(dir)]++
+	}
+	names := make([]string, len(dirs))
+	for i, dir := range dirs {
+		names[i] = filepath.Base(dir)
+		if count[names[i]] > 1 {
+			names[i] += "-" + libraryTrackID(dir)
+		}
+	}
+	return names
+}
+
+// libraryTrackID stable identifier for the file at fullPath
+func libraryTrackID(fullPath string) string {
+	sum := sha1.Sum([]byte(fullPath))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Scan walk every library directory and rebuild the index.
+// Files which haven't changed since the last scan aren't read again.
+func (l *Library) Scan() error {
+	l.mu.Lock()
+	if l.isScanning {
+		l.mu.Unlock()
+		return errors.New("ScanInProgress")
+	}
+	l.isScanning = true
+	previous := l.tracks
+	l.mu.Unlock()
+	start := time.Now()
+	tracks := map[string]*LibraryTrack{}
+	var scanErr error
+	for i, dir := range l.dirs {
+		dirName := l.dirNames[i]
+		walkErr := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil // skip what can't be read, rather than giving up on the whole directory
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			id := libraryTrackID(fullPath)
+			if old, ok := previous[id]; ok && old.Size == info.Size() && old.Modified.Equal(info.ModTime()) {
+				tracks[id] = old
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, fullPath)
+			track, readErr := readLibraryTrack(fullPath)
+			if readErr != nil {
+				return nil // not audio
+			}
+			track.ID = id
+			track.Path = path.Join(dirName, filepath.ToSlash(rel))
+			track.Size = info.Size()
+			track.Modified = info.ModTime()
+			tracks[id] = track
+			return nil
+		})
+		if walkErr != nil && scanErr == nil {
+			scanErr = walkErr
+		}
+		if _, statErr := os.Stat(dir); statErr != nil && scanErr == nil {
+			scanErr = statErr
+		}
+	}
+	sorted := make([]*LibraryTrack, 0, len(tracks))
+	byPath := map[string]*LibraryTrack{}
+	for _, track := range tracks {
+		sorted = append(sorted, track)
+		byPath[track.Path] = track
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	l.mu.Lock()
+	l.tracks = tracks
+	l.sorted = sorted
+	l.byPath = byPath
+	l.scannedAt = time.Now()
+	l.scanErr = scanErr
+	l.isScanning = false
+	l.mu.Unlock()
+	fmt.Printf("Library scan found %d tracks in %s\n", len(sorted), time.Since(start))
+	return scanErr
+}
+
+// readLibraryTrack probe & read the tags of an audio file; cover art is left on disk
+func readLibraryTrack(fullPath string) (*LibraryTrack, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mime, err := probeAudioFormat(file)
+	if err != nil {
+		return nil, err
+	}
+	track := &LibraryTrack{Type: mime, fullPath: fullPath}
+	track.Info = readTrackInfo(file, mime)
+	track.Info.Cover = nil
+	return track, nil
+}
+
+// Track get the track with the ID
+func (l *Library) Track(id string) (*LibraryTrack, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	track, ok := l.tracks[id]
+	return track, ok
+}
+
+// TrackByPath get the track with the library path, as listed by Find
+func (l *Library) TrackByPath(libraryPath string) (*LibraryTrack, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	track, ok := l.byPath[libraryPath]
+	return track, ok
+}
+
+// TrackByFile get the track for a file on disk, if it is in the library
+func (l *Library) TrackByFile(fullPath string) (*LibraryTrack, bool) {
+	return l.Track(libraryTrackID(fullPath))
+}
+
+// LibraryQuery which tracks to list; empty fields match everything
+type LibraryQuery struct {
+	Search string // every word must appear in the title, artist, album or path
+	Artist string // exact, ignoring case
+	Album  string // exact, ignoring case
+	Dir    string // path prefix, slash separated
+	Offset int
+	Limit  int
+}
+
+// Find list tracks matching the query, sorted by path, along with how many matched in total
+func (l *Library) Find(q LibraryQuery) ([]*LibraryTrack, int) {
+	words := strings.Fields(strings.ToLower(q.Search))
+	dir := strings.Trim(q.Dir, "/")
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	matches := []*LibraryTrack{}
+	for _, track := range l.sorted {
+		if q.Artist != "" && !strings.EqualFold(track.Info.Artist, q.Artist) {
+			continue
+		}
+		if q.Album != "" && !strings.EqualFold(track.Info.Album, q.Album) {
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(track.Path, dir+"/") {
+			continue
+		}
+		if len(words) != 0 && !track.matches(words) {
+			continue
+		}
+		matches = append(matches, track)
+	}
+	total := len(matches)
+	if q.Offset >= total {
+		return []*LibraryTrack{}, total
+	}
+	matches = matches[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+	return matches, total
+}
+
+func (t *LibraryTrack) matches(words []string) bool {
+	text := strings.ToLower(strings.Join([]string{t.Info.Title, t.Info.Artist, t.Info.Album, t.Path}, "\n"))
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Status when the library was last scanned, whether it is being scanned and what went wrong last time
+func (l *Library) Status() (scannedAt time.Time, isScanning bool, count int, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.scannedAt, l.isScanning, len(l.tracks), l.scanErr
+}
+
+type libraryBody struct {
+	Total     int             `json:"total"`
+	Offset    int             `json:"offset"`
+	Scanning  bool            `json:"scanning"`
+	ScannedAt time.Time       `json:"scanned_at"`
+	Tracks    []*LibraryTrack `json:"tracks"`
+}
+
+// libraryHandler browse & search the library, or queue tracks from it:
+// GET /library, GET /library/{id}, GET /library/{id}/cover, POST /library/{id}/enqueue & POST /library/scan
+func libraryHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if LibraryInst == nil {
+		writeError(w, 404, "The library is disabled")
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, LibraryPrefix), "/")
+	if rest == "" {
+		libraryListHandler(w, r)
+		return
+	}
+	if rest == "scan" {
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		go LibraryInst.Scan()
+		w.WriteHeader(202)
+		return
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	track, ok := LibraryInst.Track(parts[0])
+	if !ok {
+		writeError(w, 404, fmt.Sprintf("No library track %q", parts[0]))
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch action {
+	case "":
+		if allowMethods(w, r, "GET") {
+			writeJSON(w, 200, track)
+		}
+	case "cover":
+		if allowMethods(w, r, "GET") {
+			libraryCoverHandler(w, track)
+		}
+	case "enqueue":
+		if allowMethods(w, r, "POST") {
+			libraryEnqueueHandler(w, r, track)
+		}
+	default:
+		writeError(w, 404, fmt.Sprintf("Unknown library action %q", action))
+	}
+}
+
+func libraryListHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	query := LibraryQuery{
+		Search: r.FormValue("q"),
+		Artist: r.FormValue("artist"),
+		Album:  r.FormValue("album"),
+		Dir:    r.FormValue("dir"),
+		Limit:  DefaultLibraryLimit,
+	}
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		str := r.FormValue(name)
+		if str == "" {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			writeError(w, 400, fmt.Sprintf("Invalid %s %q", name, str))
+			return
+		}
+		*value = n
+	}
+	if query.Limit == 0 || query.Limit > MaxLibraryLimit {
+		query.Limit = MaxLibraryLimit
+	}
+	tracks, total := LibraryInst.Find(query)
+	scannedAt, isScanning, _, _ := LibraryInst.Status()
+	writeJSON(w, 200, libraryBody{
+		Total:     total,
+		Offset:    query.Offset,
+		Scanning:  isScanning,
+		ScannedAt: scannedAt,
+		Tracks:    tracks,
+	})
+}
+
+func libraryCoverHandler(w http.ResponseWriter, track *LibraryTrack) {
+	if !track.Info.HasCover {
+		writeError(w, 404, fmt.Sprintf("Library track %s has no cover art", track.ID))
+		return
+	}
+	file, err := os.Open(track.fullPath)
+	if err != nil {
+		writeError(w, 404, fmt.Sprintf("Library track %s is no longer on disk", track.ID))
+		return
+	}
+	defer file.Close()
+	writeCover(w, readTrackInfo(file, track.Type))
+}
+
+func libraryEnqueueHandler(w http.ResponseWriter, r *http.Request, track *LibraryTrack) {
+	if err := checkAllowedFormat(track.Type); err != nil {
+		rejectUnsupported(w, track.Path, err)
+		return
+	}
+	var index int
+	var err error
+	if r.FormValue("next") == "true" {
+		index, err = playerOf(r).EnqueueFileNext(track.fullPath)
+	} else {
+		index, err = playerOf(r).EnqueueFile(track.fullPath)
+	}
+	if os.IsNotExist(err) {
+		writeError(w, 404, fmt.Sprintf("Library track %s is no longer on disk", track.ID))
+		return
+	} else if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to queue %q: %s", track.Path, err))
+		return
+	}
+	fmt.Println("Queuing library track " + track.Path)
+	writeJSON(w, 200, musicQueuedBody{Queued: []musicQueued{{Name: track.Path, Index: index}}})
+}
+
+// parseLibraryDirs split the -library flag into absolute directories; relative ones are inside RootPath
+func parseLibraryDirs(value string) []string {
+	dirs := []string{}
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(RootPath, dir)
+		}
+		absDir, err := filepath.Abs(dir)
+		if err == nil {
+			dir = absDir
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestLibraryDir create a directory holding two tracks, one in a subdirectory, and a file which isn't audio
+func newTestLibraryDir(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "iomlibrary")
+	track, _ := ioutil.ReadAll(generateTestTrack(time.Second))
+	os.Mkdir(filepath.Join(dir, "rock"), 0755)
+	for _, name := range []string{"intro.wav", filepath.Join("rock", "loud.wav")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), track, 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile() raised error %s", err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not really a song"), 0644)
+	return dir
+}
+
+func TestLibraryScan(t *testing.T) {
+	dir := newTestLibraryDir(t)
+	defer os.RemoveAll(dir)
+	library := NewLibrary([]string{dir})
+	if err := library.Scan(); err != nil {
+		t.Fatalf("library.Scan() raised error %s", err)
+	}
+	base := filepath.Base(dir)
+	tracks, total := library.Find(LibraryQuery{})
+	if total != 2 || tracks[0].Path != base+"/intro.wav" || tracks[1].Path != base+"/rock/loud.wav" {
+		t.Fatalf("Unexpected library contents %+v", tracks)
+	}
+	if tracks[0].Type != MimeWav || tracks[0].Info.Duration != 1 {
+		t.Errorf("Expected 1s WAV, got %+v", tracks[0])
+	}
+	for query, expected := range map[LibraryQuery]int{
+		{Search: "LOUD"}:           1,
+		{Search: "rock wav"}:       1,
+		{Search: "jazz"}:           0,
+		{Dir: base + "/rock"}:      1,
+		{Dir: base + "/ro"}:        0,
+		{Offset: 1}:                1,
+		{Limit: 1}:                 1,
+		{Search: "wav", Offset: 5}: 0,
+	} {
+		if found, _ := library.Find(query); len(found) != expected {
+			t.Errorf("Expected %d tracks for %+v, found %d", expected, query, len(found))
+		}
+	}
+	// rescanning picks up changes, and keeps identifiers stable
+	id := tracks[1].ID
+	os.Remove(filepath.Join(dir, "intro.wav"))
+	os.Rename(filepath.Join(dir, "notes.txt"), filepath.Join(dir, "notes.wav"))
+	library.Scan()
+	if _, total = library.Find(LibraryQuery{}); total != 1 {
+		t.Errorf("Expected 1 track after rescan, found %d", total)
+	}
+	if _, ok := library.Track(id); !ok {
+		t.Errorf("Track %s disappeared after rescan", id)
+	}
+	if err := NewLibrary([]string{filepath.Join(dir, "missing")}).Scan(); err == nil {
+		t.Errorf("Expected error scanning a missing directory")
+	}
+}
+
+func TestLibrarySameDirNames(t *testing.T) {
+	first, second := newTestLibraryDir(t), newTestLibraryDir(t)
+	defer os.RemoveAll(first)
+	defer os.RemoveAll(second)
+	// like /a/music & /b/music
+	dirs := []string{filepath.Join(first, "rock"), filepath.Join(second, "rock")}
+	library := NewLibrary(dirs)
+	library.Scan()
+	tracks, total := library.Find(LibraryQuery{})
+	if total != 2 || tracks[0].Path == tracks[1].Path {
+		t.Fatalf("Expected both directories' tracks with different paths, got %+v", tracks)
+	}
+	for _, track := range tracks {
+		if found, ok := library.TrackByPath(track.Path); !ok || found.ID != track.ID {
+			t.Errorf("Expected %s to find its own track, got %+v", track.Path, found)
+		}
+	}
+}
+
+func TestLibraryHandler(t *testing.T) {
+	dir := newTestLibraryDir(t)
+	defer os.RemoveAll(dir)
+	PlayerInst = newTestPlayer()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	LibraryInst = nil
+	if rec := doTestRequest(mux, "GET", LibraryPrefix); rec.Code != 404 {
+		t.Errorf("Expected status 404 while the library is disabled, got %d", rec.Code)
+	}
+	LibraryInst = NewLibrary([]string{dir})
+	defer func() { LibraryInst = nil }()
+	LibraryInst.Scan()
+
+	rec := doTestRequest(mux, "GET", LibraryPrefix+"?q=loud")
+	var body libraryBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != 200 {
+		t.Fatalf("Unexpected library response %d %s", rec.Code, rec.Body)
+	}
+	if body.Total != 1 || body.ScannedAt.IsZero() {
+		t.Fatalf("Expected 1 matching track, got %+v", body)
+	}
+	id := body.Tracks[0].ID
+	if rec = doTestRequest(mux, "GET", LibraryPrefix+"/"+id); rec.Code != 200 {
+		t.Errorf("Expected status 200 for library track, got %d", rec.Code)
+	}
+	rec = doTestRequest(mux, "POST", LibraryPrefix+"/"+id+"/enqueue")
+	var queued musicQueuedBody
+	json.Unmarshal(rec.Body.Bytes(), &queued)
+	if rec.Code != 200 || len(queued.Queued) != 1 || queued.Queued[0].Index != 0 {
+		t.Fatalf("Unexpected enqueue response %d %s", rec.Code, rec.Body)
+	}
+	if entry, err := PlayerInst.Entry(0); err != nil || entry.Meta.Type != MimeWav {
+		t.Errorf("Expected library track in the queue, got %+v, %v", entry, err)
+	}
+	for path, expected := range map[string]int{
+		LibraryPrefix + "/nope":             404,
+		LibraryPrefix + "/" + id + "/eat":   404,
+		LibraryPrefix + "/" + id + "/cover": 404,
+		LibraryPrefix + "?limit=-1":         400,
+	} {
+		if rec = doTestRequest(mux, "GET", path); rec.Code != expected {
+			t.Errorf("Expected status %d for %s, got %d", expected, path, rec.Code)
+		}
+	}
+	if rec = doTestRequest(mux, "GET", LibraryPrefix+"/"+id+"/enqueue"); rec.Code != 405 {
+		t.Errorf("Expected status 405 for GET enqueue, got %d", rec.Code)
+	}
+}
+
+func TestLibraryCover(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomlibrary")
+	defer os.RemoveAll(dir)
+	// cover art whose tag claims it's a web page
+	data := append([]byte("fLaC"), flacBlock(0, false, make([]byte, 34))...)
+	data = append(data, flacBlock(6, true, flacPicture("text/html", []byte("<script>alert(1)</script>")))...)
+	ioutil.WriteFile(filepath.Join(dir, "art.flac"), data, 0644)
+	LibraryInst = NewLibrary([]string{dir})
+	defer func() { LibraryInst = nil }()
+	LibraryInst.Scan()
+	tracks, _ := LibraryInst.Find(LibraryQuery{})
+	if len(tracks) != 1 || !tracks[0].Info.HasCover {
+		t.Fatalf("Expected a track with cover art, got %+v", tracks)
+	}
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	rec := doTestRequest(mux, "GET", LibraryPrefix+"/"+tracks[0].ID+"/cover")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/octet-stream" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Unexpected cover response %d %v", rec.Code, rec.Header())
+	}
+}
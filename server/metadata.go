@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+)
+
+// TrackInfo descriptive information about a track, from its tags and headers
+type TrackInfo struct {
+	Title      string  `json:"title,omitempty"`
+	Artist     string  `json:"artist,omitempty"`
+	Album      string  `json:"album,omitempty"`
+	Duration   float64 `json:"duration"` // seconds
+	SampleRate int     `json:"sample_rate"`
+	HasCover   bool    `json:"has_cover"`
+	Cover      []byte  `json:"-"`
+	CoverType  string  `json:"cover_type,omitempty"`
+}
+
+// readTrackInfo parse tags & stream headers of an audio file of the given MIME type.
+// Only the start & end of the file and its stream headers are read; it's never decoded.
+// Fields which can't be found, including a duration the headers don't give, are left empty.
+// The file's position is reset afterwards.
+func readTrackInfo(file io.ReadSeeker, mime string) (info TrackInfo) {
+	defer file.Seek(0, io.SeekStart)
+	tail, err := readTail(file, tagTailBytes)
+	if err != nil {
+		return
+	}
+	switch mime {
+	case MimeMP3:
+		parseID3v1(tail, &info)
+		parseID3v2(file, &info) // v2 takes priority over v1
+		parseMP3Duration(file, tail, &info)
+	case MimeWav:
+		parseWavFormat(file, &info)
+	case MimeFLAC:
+		parseFLACMetadata(file, &info)
+	case MimeVorbis:
+		parseOggVorbis(file, &info)
+		parseOggDuration(tail, &info)
+	}
+	return
+}
+
+// readField read the next n bytes of r, refusing fields too big to hold in memory
+func readField(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 || n > maxTagBytes {
+		return nil, errors.New("FieldTooLarge")
+	}
+	field := make([]byte, n)
+	_, err := io.ReadFull(r, field)
+	return field, err
+}
+
+// readTail read up to n bytes from the end of file
+func readTail(file io.ReadSeeker, n int64) ([]byte, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if n > size {
+		n = size
+	}
+	_, err = file.Seek(-n, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(file)
+}
+
+const (
+	maxTagBytes  = 16 * 1024 * 1024 // largest tag field, such as cover art, which is read into memory
+	tagTailBytes = 64*1024 + 512    // enough of the end of a file for an ID3v1 tag or the whole last Ogg page
+)
+
+// ID3
+
+func parseID3v1(data []byte, info *TrackInfo) {
+	if len(data) < 128 {
+		return
+	}
+	tag := data[len(data)-128:]
+	if string(tag[0:3]) != "TAG" {
+		return
+	}
+	info.Title = trimTagString(string(tag[3:33]))
+	info.Artist = trimTagString(string(tag[33:63]))
+	info.Album = trimTagString(string(tag[63:93]))
+}
+
+// parseID3v2 read the ID3v2 tag at the start of file a frame at a time, skipping over the frames which aren't needed
+func parseID3v2(file io.ReadSeeker, info *TrackInfo) {
+	header := make([]byte, 10)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(file, header); err != nil || string(header[0:3]) != "ID3" {
+		return
+	}
+	version := header[3]
+	flags := header[5]
+	size := int64(syncsafe(header[6:10]))
+	var tag io.Reader = io.LimitReader(file, size)
+	if flags&0x80 != 0 && version < 4 {
+		// the whole tag has to be read to undo unsynchronisation
+		data, err := readField(tag, size)
+		if err != nil {
+			return
+		}
+		tag = bytes.NewReader(bytes.Replace(data, []byte{0xFF, 0x00}, []byte{0xFF}, -1))
+	}
+	if flags&0x40 != 0 && version >= 3 {
+		// skip extended header
+		sizeField, err := readField(tag, 4)
+		if err != nil {
+			return
+		}
+		extSize := int64(binary.BigEndian.Uint32(sizeField))
+		if version == 4 {
+			extSize = int64(syncsafe(sizeField)) - 4 // v2.4 counts the size field too
+		}
+		if _, err = io.CopyN(ioutil.Discard, tag, extSize); err != nil {
+			return
+		}
+	}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	frameHeader := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(tag, frameHeader); err != nil || frameHeader[0] == 0 {
+			return // end of the tag, or padding
+		}
+		id := string(frameHeader[0:idLen])
+		var frameSize int64
+		switch version {
+		case 2:
+			frameSize = int64(frameHeader[3])<<16 | int64(frameHeader[4])<<8 | int64(frameHeader[5])
+		case 3:
+			frameSize = int64(binary.BigEndian.Uint32(frameHeader[4:8]))
+		default:
+			frameSize = int64(syncsafe(frameHeader[4:8]))
+		}
+		switch id {
+		case "TIT2", "TT2", "TPE1", "TP1", "TALB", "TAL", "APIC", "PIC":
+		default:
+			if _, err := io.CopyN(ioutil.Discard, tag, frameSize); err != nil {
+				return
+			}
+			continue
+		}
+		frame, err := readField(tag, frameSize)
+		if err != nil {
+			return
+		}
+		switch id {
+		case "TIT2", "TT2":
+			info.Title = decodeID3Text(frame)
+		case "TPE1", "TP1":
+			info.Artist = decodeID3Text(frame)
+		case "TALB", "TAL":
+			info.Album = decodeID3Text(frame)
+		case "APIC":
+			parseID3Picture(frame, false, info)
+		case "PIC":
+			parseID3Picture(frame, true, info)
+		}
+	}
+}
+
+// MPEG audio
+
+var (
+	mp3SampleRates = [3]int{44100, 48000, 32000} // MPEG-1; halved for MPEG-2 & quartered for MPEG-2.5
+	mp3Bitrates    = [2][15]int{                 // layer III, in kbit/s
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}, // MPEG-1
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},     // MPEG-2 & 2.5
+	}
+)
+
+// parseMP3Duration find the length of an MP3 file from its first frame: the frame count of a Xing or VBRI header,
+// or else the size of the audio at the first frame's bitrate. tail is the end of the file, which may hold an ID3v1 tag.
+func parseMP3Duration(file io.ReadSeeker, tail []byte, info *TrackInfo) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	header, err := readHeaderAt(file, 0)
+	if err != nil {
+		return
+	}
+	start := id3v2End(header)
+	frame, err := readHeaderAt(file, start)
+	if err != nil || !isMPEGFrame(frame) {
+		return
+	}
+	version := (frame[1] >> 3) & 0x03 // 3 for MPEG-1, 2 for MPEG-2, 0 for MPEG-2.5
+	isMono := frame[3]>>6 == 0x03
+	sampleRate := mp3SampleRates[(frame[2]>>2)&0x03]
+	samplesPerFrame := 1152
+	sideInfo := 32
+	bitrates := mp3Bitrates[0]
+	if version != 3 {
+		sampleRate /= 2
+		samplesPerFrame = 576
+		sideInfo = 17
+		bitrates = mp3Bitrates[1]
+	}
+	if version == 0 {
+		sampleRate /= 2
+	}
+	if isMono {
+		sideInfo = (sideInfo + 1) / 2 // 17 for MPEG-1, 9 otherwise
+	}
+	info.SampleRate = sampleRate
+	if len(frame) < probeHeaderSize {
+		return // too short to hold more than one frame
+	}
+	// a VBR file starts with a frame holding its frame count
+	if xing := frame[4+sideInfo:]; len(xing) >= 12 && (string(xing[0:4]) == "Xing" || string(xing[0:4]) == "Info") {
+		if binary.BigEndian.Uint32(xing[4:8])&0x01 != 0 {
+			frames := binary.BigEndian.Uint32(xing[8:12])
+			info.Duration = float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+		}
+		return
+	}
+	if vbri := frame[4+32:]; len(vbri) >= 18 && string(vbri[0:4]) == "VBRI" {
+		frames := binary.BigEndian.Uint32(vbri[14:18])
+		info.Duration = float64(frames) * float64(samplesPerFrame) / float64(sampleRate)
+		return
+	}
+	// otherwise assume a constant bitrate
+	bitrate := bitrates[frame[2]>>4] * 1000
+	audioSize := size - start
+	if len(tail) >= 128 && string(tail[len(tail)-128:len(tail)-125]) == "TAG" {
+		audioSize -= 128
+	}
+	if bitrate != 0 && audioSize > 0 {
+		info.Duration = float64(audioSize) * 8 / float64(bitrate)
+	}
+}
+
+// WAV
+
+// parseWavFormat find the sample rate from a WAV file's fmt chunk, and its length from the size of its data chunk
+func parseWavFormat(file io.ReadSeeker, info *TrackInfo) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	pos := int64(12) // after RIFF, the RIFF size & WAVE
+	byteRate := 0
+	chunk := make([]byte, 8+16)
+	for pos+8 <= size {
+		if _, err = file.Seek(pos, io.SeekStart); err != nil {
+			return
+		}
+		n, _ := io.ReadFull(file, chunk)
+		if n < 8 {
+			return
+		}
+		id := string(chunk[0:4])
+		length := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch {
+		case id == "fmt " && n >= 8+16:
+			info.SampleRate = int(binary.LittleEndian.Uint32(chunk[12:16]))
+			byteRate = int(binary.LittleEndian.Uint32(chunk[16:20]))
+		case id == "data":
+			if length > size-pos-8 {
+				length = size - pos - 8 // streamed, or cut short
+			}
+			if byteRate != 0 {
+				info.Duration = float64(length) / float64(byteRate)
+			}
+			return
+		}
+		pos += 8 + length + length%2 // chunks are padded to an even length
+	}
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// decodeID3Text decode a text frame, whose first byte is the text encoding
+func decodeID3Text(frame []byte) string {
+	if len(frame) < 1 {
+		return ""
+	}
+	return trimTagString(decodeID3String(frame[0], frame[1:]))
+}
+
+func decodeID3String(encoding byte, data []byte) string {
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+			bigEndian, data = true, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+			bigEndian, data = false, data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(data[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(data[i:]))
+			}
+		}
+		return string(utf16.Decode(units))
+	case 3: // UTF-8
+		return string(data)
+	}
+	// ISO-8859-1
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// id3Terminator find the end of a null-terminated string in the given encoding
+func id3Terminator(encoding byte, data []byte) (end, next int) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return i, i + 2
+			}
+		}
+		return len(data), len(data)
+	}
+	i := bytes.IndexByte(data, 0)
+	if i == -1 {
+		return len(data), len(data)
+	}
+	return i, i + 1
+}
+
+func parseID3Picture(frame []byte, isV22 bool, info *TrackInfo) {
+	if info.HasCover || len(frame) < 2 {
+		return
+	}
+	encoding := frame[0]
+	rest := frame[1:]
+	var mime string
+	if isV22 {
+		if len(rest) < 3 {
+			return
+		}
+		mime = "image/" + strings.ToLower(string(rest[0:3]))
+		if mime == "image/jpg" {
+			mime = "image/jpeg"
+		}
+		rest = rest[3:]
+	} else {
+		end := bytes.IndexByte(rest, 0)
+		if end == -1 {
+			return
+		}
+		mime = string(rest[:end])
+		rest = rest[end+1:]
+	}
+	if len(rest) < 1 {
+		return
+	}
+	rest = rest[1:] // picture type
+	_, next := id3Terminator(encoding, rest)
+	setCover(info, mime, rest[next:])
+}
+
+// FLAC
+
+// parseFLACMetadata read the metadata blocks at the start of file, seeking past the ones which aren't needed
+func parseFLACMetadata(file io.ReadSeeker, info *TrackInfo) {
+	header := make([]byte, 4)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(file, header); err != nil || string(header) != "fLaC" {
+		return
+	}
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			return
+		}
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		if blockType != 0 && blockType != 4 && blockType != 6 {
+			if _, err := file.Seek(length, io.SeekCurrent); err != nil {
+				return
+			}
+		} else {
+			block, err := readField(file, length)
+			if err != nil {
+				return
+			}
+			switch blockType {
+			case 0: // STREAMINFO
+				if len(block) >= 18 {
+					sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+					totalSamples := int64(block[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+					info.SampleRate = sampleRate
+					if sampleRate != 0 {
+						info.Duration = float64(totalSamples) / float64(sampleRate)
+					}
+				}
+			case 4: // VORBIS_COMMENT
+				parseVorbisComment(block, info)
+			case 6: // PICTURE
+				parseFLACPicture(block, info)
+			}
+		}
+		if header[0]&0x80 != 0 { // last metadata block
+			return
+		}
+	}
+}
+
+func parseFLACPicture(block []byte, info *TrackInfo) {
+	if info.HasCover {
+		return
+	}
+	r := bytes.NewReader(block)
+	var pictureType, length uint32
+	binary.Read(r, binary.BigEndian, &pictureType)
+	mime, err := readLengthPrefixed(r, binary.BigEndian)
+	if err != nil {
+		return
+	}
+	if _, err = readLengthPrefixed(r, binary.BigEndian); err != nil { // description
+		return
+	}
+	r.Seek(16, io.SeekCurrent) // width, height, depth, colours
+	if binary.Read(r, binary.BigEndian, &length) != nil || int64(length) > int64(r.Len()) {
+		return
+	}
+	picture := make([]byte, length)
+	r.Read(picture)
+	setCover(info, string(mime), picture)
+}
+
+func readLengthPrefixed(r *bytes.Reader, order binary.ByteOrder) ([]byte, error) {
+	var length uint32
+	err := binary.Read(r, order, &length)
+	if err != nil {
+		return nil, err
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, errors.New("TruncatedField")
+	}
+	field := make([]byte, length)
+	_, err = r.Read(field)
+	return field, err
+}
+
+// Vorbis
+
+func parseVorbisComment(block []byte, info *TrackInfo) {
+	r := bytes.NewReader(block)
+	if _, err := readLengthPrefixed(r, binary.LittleEndian); err != nil { // vendor
+		return
+	}
+	var count uint32
+	if binary.Read(r, binary.LittleEndian, &count) != nil {
+		return
+	}
+	for i := uint32(0); i < count; i++ {
+		comment, err := readLengthPrefixed(r, binary.LittleEndian)
+		if err != nil {
+			return
+		}
+		eq := bytes.IndexByte(comment, '=')
+		if eq == -1 {
+			continue
+		}
+		value := string(comment[eq+1:])
+		switch strings.ToUpper(string(comment[:eq])) {
+		case "TITLE":
+			info.Title = value
+		case "ARTIST":
+			info.Artist = value
+		case "ALBUM":
+			info.Album = value
+		case "METADATA_BLOCK_PICTURE":
+			picture, decodeErr := base64.StdEncoding.DecodeString(value)
+			if decodeErr == nil {
+				parseFLACPicture(picture, info)
+			}
+		}
+	}
+}
+
+// parseOggVorbis read the identification & comment headers at the start of file
+func parseOggVorbis(file io.ReadSeeker, info *TrackInfo) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	packets := readOggPackets(file, 2)
+	if len(packets) >= 1 && len(packets[0]) >= 16 && string(packets[0][1:7]) == "vorbis" {
+		info.SampleRate = int(binary.LittleEndian.Uint32(packets[0][12:16]))
+	}
+	if len(packets) >= 2 && len(packets[1]) >= 7 && string(packets[1][1:7]) == "vorbis" {
+		parseVorbisComment(packets[1][7:], info)
+	}
+}
+
+// parseOggDuration find the length of an Ogg stream from data ending with its last page, once the sample rate is known
+func parseOggDuration(data []byte, info *TrackInfo) {
+	// the granule position of the last page is the total sample count
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last != -1 && last+14 <= len(data) && info.SampleRate != 0 {
+		granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+		if granule > 0 {
+			info.Duration = float64(granule) / float64(info.SampleRate)
+		}
+	}
+}
+
+// readOggPackets reassemble up to count packets from the start of an Ogg stream, a page at a time
+func readOggPackets(r io.Reader, count int) [][]byte {
+	packets := [][]byte{}
+	var packet []byte
+	header := make([]byte, 27)
+	for len(packets) < count {
+		if _, err := io.ReadFull(r, header); err != nil || string(header[0:4]) != "OggS" {
+			return packets
+		}
+		table, err := readField(r, int64(header[26]))
+		if err != nil {
+			return packets
+		}
+		for _, segLen := range table {
+			if len(packet)+int(segLen) > maxTagBytes {
+				return packets
+			}
+			segment, err := readField(r, int64(segLen))
+			if err != nil {
+				return packets
+			}
+			packet = append(packet, segment...)
+			if segLen < 255 {
+				packets = append(packets, packet)
+				packet = nil
+				if len(packets) == count {
+					return packets
+				}
+			}
+		}
+	}
+	return packets
+}
+
+// helpers
+
+// coverTypes image types cover art is served as; tags can claim any type, like text/html
+var coverTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true}
+
+func setCover(info *TrackInfo, mime string, picture []byte) {
+	if len(picture) == 0 {
+		return
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	if !coverTypes[mime] {
+		mime = http.DetectContentType(picture)
+		if !coverTypes[mime] {
+			mime = "application/octet-stream"
+		}
+	}
+	info.HasCover = true
+	info.Cover = picture
+	info.CoverType = mime
+}
+
+// writeCover respond with a track's cover art, which browsers mustn't treat as anything but its type
+func writeCover(w http.ResponseWriter, info TrackInfo) {
+	w.Header().Set("Content-Type", info.CoverType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(info.Cover)
+}
+
+func trimTagString(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
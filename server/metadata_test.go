@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func id3v23Frame(id string, body []byte) []byte {
+	frame := []byte(id)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(body)))
+	frame = append(frame, size...)
+	frame = append(frame, 0, 0) // flags
+	return append(frame, body...)
+}
+
+func vorbisComment(comments ...string) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, uint32(4))
+	buf.WriteString("test")
+	binary.Write(buf, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		binary.Write(buf, binary.LittleEndian, uint32(len(c)))
+		buf.WriteString(c)
+	}
+	return buf.Bytes()
+}
+
+func flacPicture(mime string, picture []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(3)) // front cover
+	binary.Write(buf, binary.BigEndian, uint32(len(mime)))
+	buf.WriteString(mime)
+	binary.Write(buf, binary.BigEndian, uint32(0)) // description
+	buf.Write(make([]byte, 16))
+	binary.Write(buf, binary.BigEndian, uint32(len(picture)))
+	buf.Write(picture)
+	return buf.Bytes()
+}
+
+func flacBlock(blockType byte, isLast bool, body []byte) []byte {
+	if isLast {
+		blockType |= 0x80
+	}
+	return append([]byte{blockType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestParseID3v2(t *testing.T) {
+	frames := id3v23Frame("PRIV", bytes.Repeat([]byte{0xFF}, 1000)) // skipped over
+	frames = append(frames, id3v23Frame("TIT2", append([]byte{3}, "Title"...))...)
+	frames = append(frames, id3v23Frame("TPE1", []byte{1, 0xFF, 0xFE, 'A', 0, 'r', 0})...) // UTF-16LE
+	frames = append(frames, id3v23Frame("TALB", append([]byte{0}, "Album"...))...)
+	frames = append(frames, id3v23Frame("APIC", append([]byte{0}, "image/png\x00\x03desc\x00PNGDATA"...))...)
+	data := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 0}
+	data[9] = byte(len(frames) & 0x7F)
+	data[8] = byte(len(frames) >> 7)
+	data = append(data, frames...)
+	var info TrackInfo
+	parseID3v2(bytes.NewReader(data), &info)
+	if info.Title != "Title" || info.Artist != "Ar" || info.Album != "Album" {
+		t.Errorf("Unexpected ID3v2 text %+v", info)
+	}
+	if !info.HasCover || info.CoverType != "image/png" || string(info.Cover) != "PNGDATA" {
+		t.Errorf("Unexpected ID3v2 cover %q (%s)", info.Cover, info.CoverType)
+	}
+	if parseID3v2(bytes.NewReader([]byte("ID3")), &info); info.Title != "Title" {
+		t.Errorf("Truncated tag modified info")
+	}
+}
+
+func TestParseID3v1(t *testing.T) {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:], "Old Title")
+	copy(tag[33:], "Old Artist")
+	copy(tag[63:], "Old Album")
+	var info TrackInfo
+	parseID3v1(append(make([]byte, 1000), tag...), &info)
+	if info.Title != "Old Title" || info.Artist != "Old Artist" || info.Album != "Old Album" {
+		t.Errorf("Unexpected ID3v1 info %+v", info)
+	}
+}
+
+func TestParseFLACMetadata(t *testing.T) {
+	streamInfo := make([]byte, 34)
+	// 44100 Hz (20 bits) then channels & bits per sample, then 36 bits of total samples
+	rate := 44100
+	streamInfo[10] = byte(rate >> 12)
+	streamInfo[11] = byte(rate >> 4)
+	streamInfo[12] = byte(rate<<4) | 0x02
+	binary.BigEndian.PutUint32(streamInfo[14:18], uint32(rate*90))
+	data := []byte("fLaC")
+	data = append(data, flacBlock(0, false, streamInfo)...)
+	data = append(data, flacBlock(4, false, vorbisComment("title=Flac Title", "ARTIST=Flac Artist", "Album=Flac Album"))...)
+	data = append(data, flacBlock(6, true, flacPicture("image/jpeg", []byte("JPEGDATA")))...)
+	var info TrackInfo
+	parseFLACMetadata(bytes.NewReader(data), &info)
+	if info.Title != "Flac Title" || info.Artist != "Flac Artist" || info.Album != "Flac Album" {
+		t.Errorf("Unexpected FLAC comments %+v", info)
+	}
+	if info.SampleRate != 44100 || info.Duration != 90 {
+		t.Errorf("Unexpected FLAC stream info %d Hz, %fs", info.SampleRate, info.Duration)
+	}
+	if !info.HasCover || info.CoverType != "image/jpeg" || string(info.Cover) != "JPEGDATA" {
+		t.Errorf("Unexpected FLAC cover %q (%s)", info.Cover, info.CoverType)
+	}
+}
+
+func TestParseMP3Duration(t *testing.T) {
+	header := []byte{0xFF, 0xFB, 0x90, 0x00} // MPEG-1 layer III, 128 kbit/s, 44100 Hz, stereo
+	cbr := append(append([]byte{}, header...), make([]byte, 16000-len(header))...)
+	cbr = append(cbr, append([]byte("TAG"), make([]byte, 125)...)...)
+	info := readTrackInfo(bytes.NewReader(cbr), MimeMP3)
+	if info.SampleRate != 44100 || info.Duration != 1 {
+		t.Errorf("Unexpected constant bitrate stream info %d Hz, %fs", info.SampleRate, info.Duration)
+	}
+	xing := append(append([]byte{}, header...), make([]byte, 32)...) // side info
+	xing = append(xing, "Xing"...)
+	xing = append(xing, 0, 0, 0, 0x01, 0, 0, 0x01, 0x13) // frame count present: 275 frames
+	xing = append(xing, make([]byte, 4000)...)
+	info = readTrackInfo(bytes.NewReader(xing), MimeMP3)
+	if expected := 275 * 1152 / 44100.0; info.Duration != expected {
+		t.Errorf("Expected a Xing header's frame count to give %fs, got %fs", expected, info.Duration)
+	}
+}
+
+func TestParseWavFormat(t *testing.T) {
+	info := readTrackInfo(generateTestTrack(2*time.Second), MimeWav)
+	if info.SampleRate != int(testTrackFormat.SampleRate) || info.Duration != 2 {
+		t.Errorf("Unexpected WAV stream info %d Hz, %fs", info.SampleRate, info.Duration)
+	}
+	// a malformed header, with a data chunk longer than the file, is never decoded
+	malformed := []byte("RIFF\xff\xff\xff\xffWAVEfmt \x10\x00\x00\x00")
+	malformed = append(malformed, 1, 0, 0, 0, 0x44, 0xAC, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	malformed = append(malformed, "data\xff\xff\xff\x7f"...)
+	malformed = append(malformed, make([]byte, 32)...)
+	info = readTrackInfo(bytes.NewReader(malformed), MimeWav)
+	if info.SampleRate != 44100 || info.Duration != 0 {
+		t.Errorf("Expected a malformed WAV file to have no duration, got %d Hz, %fs", info.SampleRate, info.Duration)
+	}
+}
+
+func oggPage(granule uint64, packets ...[]byte) []byte {
+	table := []byte{}
+	body := []byte{}
+	for _, p := range packets {
+		n := len(p)
+		for n >= 255 {
+			table = append(table, 255)
+			n -= 255
+		}
+		table = append(table, byte(n))
+		body = append(body, p...)
+	}
+	page := []byte("OggS")
+	page = append(page, 0, 0)
+	g := make([]byte, 8)
+	binary.LittleEndian.PutUint64(g, granule)
+	page = append(page, g...)
+	page = append(page, make([]byte, 12)...) // serial, sequence, checksum
+	page = append(page, byte(len(table)))
+	page = append(page, table...)
+	return append(page, body...)
+}
+
+func TestParseOggVorbis(t *testing.T) {
+	ident := make([]byte, 30)
+	ident[0] = 1
+	copy(ident[1:], "vorbis")
+	binary.LittleEndian.PutUint32(ident[12:16], 48000)
+	long := string(bytes.Repeat([]byte("x"), 300)) // forces the comment packet across segments
+	comment := append([]byte("\x03vorbis"), vorbisComment("TITLE=Ogg Title", "ARTIST=Ogg Artist", "DESCRIPTION="+long)...)
+	data := oggPage(0, ident)
+	data = append(data, oggPage(0, comment)...)
+	data = append(data, oggPage(48000*30, []byte("audio"))...)
+	info := readTrackInfo(bytes.NewReader(data), MimeVorbis)
+	if info.Title != "Ogg Title" || info.Artist != "Ogg Artist" {
+		t.Errorf("Unexpected Vorbis comments %+v", info)
+	}
+	if info.SampleRate != 48000 || info.Duration != 30 {
+		t.Errorf("Unexpected Vorbis stream info %d Hz, %fs", info.SampleRate, info.Duration)
+	}
+}
+
+func TestCoverType(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+	for _, c := range []struct {
+		mime     string
+		picture  []byte
+		expected string
+	}{
+		{"IMAGE/JPEG", []byte("JPEGDATA"), "image/jpeg"},
+		{"text/html", png, "image/png"}, // what it really is
+		{"text/html", []byte("<html><script>alert(1)</script></html>"), "application/octet-stream"},
+		{"", []byte("data"), "application/octet-stream"},
+	} {
+		var info TrackInfo
+		setCover(&info, c.mime, c.picture)
+		if info.CoverType != c.expected {
+			t.Errorf("Expected %q cover to be served as %s, got %s", c.mime, c.expected, info.CoverType)
+		}
+	}
+	rec := httptest.NewRecorder()
+	writeCover(rec, TrackInfo{HasCover: true, Cover: png, CoverType: "image/png"})
+	if rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Unexpected cover headers %v", rec.Header())
+	}
+}
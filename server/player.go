@@ -3,15 +3,15 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 
 	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
 	"github.com/faiface/beep/flac"
 	"github.com/faiface/beep/mp3"
-	"github.com/faiface/beep/speaker"
 	"github.com/faiface/beep/vorbis"
 	"github.com/faiface/beep/wav"
 
@@ -20,179 +20,840 @@ import (
 )
 
 type Player struct {
-	streamer        beep.Streamer
-	format          beep.Format
-	control         *beep.Ctrl
-	queue           *RollingQueue
-	Config          PlayerConfig
-	songDone        chan bool
-	isPaused        bool
-	isSpeakerInited bool
-	isHandling      bool
-}
-
-func NewPlayer() (p *Player) {
-	qc := QueueConfig{
-		PersistToDisk:   false,
-		MemBufferSize:   2,
-		EnableOvercache: true,
-		OvercacheSize:   2,
-	}
-	rq := NewRollingQueue(qc)
+	tracks       *trackStreamer  // output chain, set up the first time the player plays
+	control      *beep.Ctrl      // fields of the output chain must only be accessed while the sink is locked
+	volume       *effects.Volume // gain stage after control
+	volumeLevel  int             // percent of full amplitude; guarded by the sink lock
+	isMuted      bool            // guarded by the sink lock
+	queue        *RollingQueue
+	sink         AudioSink
+	Events       *EventBus
+	Config       PlayerConfig
+	QueueConfig  QueueConfig
+	commands     chan playerCommand
+	closed       chan bool // closed once the player has shut down
+	playingIndex int       // queue index of the track being output, -1 when there isn't one
+	isPaused     bool
+	isPlaying    bool
+	isSinkInited bool
+	isRestored   bool // the queue was restored onto the item which was playing, so the first play starts it again
+}
+
+// commandKind what a playerCommand asks the player to do
+type commandKind int
+
+const (
+	commandPlay commandKind = iota
+	commandPause
+	commandNext
+	commandPrevious
+	commandSetShuffle
+	commandSetRepeat
+	commandEditQueue // run edit, which renumbers the queue
+	commandAppended  // an item was added to the end of the queue
+	commandStatus
+	commandReconfigure
+	commandTimeline
+	commandClose
+)
+
+// playerCommand request for the goroutine which owns the player's state.
+// Only that goroutine moves the queue or touches the fields of Player which aren't guarded by the sink lock.
+type playerCommand struct {
+	kind    commandKind
+	shuffle bool
+	repeat  RepeatMode
+	edit    func() error
+	quality int
+	buffer  time.Duration
+	result  chan commandResult
+}
+
+// commandResult outcome of a playerCommand
+type commandResult struct {
+	err      error
+	status   PlayerStatus
+	timeline Timeline
+}
+
+// NewPlayer create a player which outputs to sink; its queue is set up by Init
+func NewPlayer(sink AudioSink) (p *Player) {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
 	p = &Player{
-		queue: &rq,
+		sink:         sink,
+		Events:       NewEventBus(),
+		commands:     make(chan playerCommand),
+		closed:       make(chan bool),
+		volumeLevel:  Volume,
+		playingIndex: -1,
 		Config: PlayerConfig{
 			BufferedTime: Buffer,
 			SampleRate:   SampleRate,
 			Quality:      Quality,
+			Crossfade:    Crossfade,
 		},
+		QueueConfig: queueConfig(),
 	}
 	return
 }
 
+// Init set up the queue and start the goroutine which carries out commands; call it once, after setting Config & QueueConfig
 func (p *Player) Init() {
-	p.songDone = make(chan bool)
-	rq := NewRollingQueue(QueueConfig{
-		PersistToDisk:   false,
-		MemBufferSize:   2,
-		EnableOvercache: true,
-		OvercacheSize:   2,
+	rq := NewRollingQueue(p.QueueConfig)
+	rq.SetEventBus(p.Events)
+	p.queue = rq
+	if rq.JournalErr() != nil {
+		fmt.Println("Queue journal restore problem: " + rq.JournalErr().Error())
+	}
+	if rq.MaximumIndex() != 0 {
+		fmt.Printf("Restored %d queue items from journal\n", rq.MaximumIndex())
+	}
+	p.isRestored = rq.Index() != -1
+	go p.run()
+}
+
+// do send a command to the player's goroutine and wait until it has been carried out
+func (p *Player) do(cmd playerCommand) commandResult {
+	cmd.result = make(chan commandResult, 1)
+	select {
+	case p.commands <- cmd:
+	case <-p.closed:
+		return commandResult{err: errors.New("PlayerClosed")}
+	}
+	return <-cmd.result
+}
+
+// run own the player's state, carrying out commands and following the output from track to track
+func (p *Player) run() {
+	for {
+		var wake chan bool
+		if p.tracks != nil {
+			wake = p.tracks.wake
+		}
+		select {
+		case cmd := <-p.commands:
+			cmd.result <- p.handle(cmd)
+			if cmd.kind == commandClose {
+				return
+			}
+		case <-wake:
+			p.followOutput()
+		}
+	}
+}
+
+func (p *Player) handle(cmd playerCommand) (result commandResult) {
+	switch cmd.kind {
+	case commandPlay:
+		p.play()
+	case commandPause:
+		p.pause()
+	case commandNext:
+		p.next()
+	case commandPrevious:
+		p.previous()
+	case commandSetShuffle:
+		p.queue.SetShuffle(cmd.shuffle)
+		p.replanNext()
+	case commandSetRepeat:
+		p.queue.SetRepeat(cmd.repeat)
+		p.replanNext()
+	case commandEditQueue:
+		result.err = p.editQueue(cmd.edit)
+	case commandAppended:
+		p.planAppended()
+	case commandStatus:
+		result.status = p.status()
+	case commandReconfigure:
+		result.err = p.reconfigure(cmd.quality, cmd.buffer)
+	case commandTimeline:
+		result.timeline = p.timeline()
+	case commandClose:
+		result.err = p.close()
+	}
+	return
+}
+
+// Enqueue add a file to the end of the queue, returning its absolute queue index
+func (p *Player) Enqueue(audioFile ReadSeekerCloser) (int, error) {
+	index, err := p.queue.Append(audioFile)
+	if err == nil {
+		p.do(playerCommand{kind: commandAppended})
+	}
+	return index, err
+}
+
+// EnqueueFile add a file on disk to the end of the queue, returning its absolute queue index
+func (p *Player) EnqueueFile(filename string) (int, error) {
+	index, err := p.queue.AppendFile(filename)
+	if err == nil {
+		p.do(playerCommand{kind: commandAppended})
+	}
+	return index, err
+}
+
+// EnqueueNext add a file straight after the current item, returning its absolute queue index
+func (p *Player) EnqueueNext(audioFile ReadSeekerCloser) (int, error) {
+	var index int
+	err := p.doEdit(func() (err error) {
+		index, err = p.queue.InsertAfterCurrent(audioFile)
+		return
+	})
+	return index, err
+}
+
+// EnqueueFileNext add a file on disk straight after the current item, returning its absolute queue index
+func (p *Player) EnqueueFileNext(filename string) (int, error) {
+	var index int
+	err := p.doEdit(func() (err error) {
+		index, err = p.queue.InsertFileAfterCurrent(filename)
+		return
 	})
-	p.queue = &rq
+	return index, err
+}
+
+// Remove take the item at the absolute index out of the queue
+func (p *Player) Remove(index int) error {
+	return p.doEdit(func() error { return p.queue.Remove(index) })
+}
+
+// Move move the item at the absolute index from to the absolute index to
+func (p *Player) Move(from, to int) error {
+	return p.doEdit(func() error { return p.queue.Move(from, to) })
 }
 
-func (p *Player) Enqueue(audioFile ReadSeekerCloser) {
-	p.queue.Append(audioFile)
+// Clear remove every queue item except the current one
+func (p *Player) Clear() error {
+	return p.doEdit(func() error { return p.queue.Clear() })
+}
+
+func (p *Player) doEdit(edit func() error) error {
+	return p.do(playerCommand{kind: commandEditQueue, edit: edit}).err
+}
+
+// editQueue make a change which renumbers the queue, then re-plan the next track to suit
+func (p *Player) editQueue(edit func() error) error {
+	if p.isPlaying {
+		p.followOutput()
+		// the pre-decoded next track could be moved or removed
+		p.discardNext()
+	}
+	err := edit()
+	if p.playingIndex != -1 {
+		p.playingIndex = p.queue.Index()
+	}
+	if p.isPlaying {
+		p.prepareNext()
+	}
+	p.publish(EventQueueChanged, p.queue.Index(), err)
+	return err
 }
 
 func (p *Player) EnqueueMany(audioFiles ...ReadSeekerCloser) {
 	for _, f := range audioFiles {
-		p.queue.Append(f)
+		p.Enqueue(f)
 	}
 }
 
 func (p *Player) Play() {
+	p.do(playerCommand{kind: commandPlay})
+}
+
+func (p *Player) Pause() {
+	p.do(playerCommand{kind: commandPause})
+}
+
+func (p *Player) Next() {
+	p.do(playerCommand{kind: commandNext})
+}
+
+func (p *Player) Previous() {
+	p.do(playerCommand{kind: commandPrevious})
+}
+
+// SetShuffle play upcoming queue items in a random order, or in the order they were queued
+func (p *Player) SetShuffle(enabled bool) {
+	p.do(playerCommand{kind: commandSetShuffle, shuffle: enabled})
+}
+
+// SetRepeat change what happens when a track or the whole queue ends
+func (p *Player) SetRepeat(mode RepeatMode) {
+	p.do(playerCommand{kind: commandSetRepeat, repeat: mode})
+}
+
+// Reconfigure change the resampling quality & output buffer while playing; the current track keeps its quality
+func (p *Player) Reconfigure(quality int, buffer time.Duration) error {
+	return p.do(playerCommand{kind: commandReconfigure, quality: quality, buffer: buffer}).err
+}
+
+func (p *Player) reconfigure(quality int, buffer time.Duration) error {
+	p.Config.Quality = quality
+	if buffer == p.Config.BufferedTime {
+		return nil
+	}
+	if p.isSinkInited {
+		err := p.sink.Resize(beep.SampleRate(p.Config.SampleRate).N(buffer))
+		if err != nil {
+			return err
+		}
+	}
+	p.Config.BufferedTime = buffer
+	return nil
+}
+
+// Close stop playing for good, close the output and clean up the queue, including items spilled to disk
+func (p *Player) Close() error {
+	return p.do(playerCommand{kind: commandClose}).err
+}
+
+func (p *Player) close() (err error) {
+	if p.tracks != nil {
+		p.sink.Lock()
+		p.tracks.current.close()
+		p.tracks.next.close()
+		p.tracks.current = nil
+		p.tracks.next = nil
+		p.sink.Unlock()
+		p.sink.Clear()
+	}
+	if p.isSinkInited {
+		err = p.sink.Close()
+	}
+	queueErr := p.queue.Close()
+	if err == nil {
+		err = queueErr
+	}
+	close(p.closed)
+	fmt.Println("Player closed")
+	return
+}
+
+// PlayMode get whether the queue is shuffled and its repeat mode
+func (p *Player) PlayMode() (shuffled bool, repeat RepeatMode) {
+	return p.queue.IsShuffled(), p.queue.Repeat()
+}
+
+func (p *Player) play() {
 	if p.isPaused {
 		p.isPaused = false
+		p.sink.Lock()
 		if p.control != nil {
 			p.control.Paused = false
 		}
+		p.sink.Unlock()
+		p.publish(EventResumed, p.queue.Index(), nil)
 	}
-	if !p.isHandling && p.queue.HasNext() {
-		go p.handleSongEnd()
-		p.songDone <- true
+	if !p.isPlaying && (p.isRestored || p.queue.HasNext()) {
+		fmt.Println("Starting playback")
+		p.startOutput()
+		p.isPlaying = true
+		if !p.isRestored {
+			p.queue.Next()
+		}
+		p.isRestored = false
+		p.playNow()
 	}
 }
 
-func (p *Player) Pause() {
+func (p *Player) pause() {
 	if !p.isPaused {
 		p.isPaused = true
+		p.sink.Lock()
 		if p.control != nil {
 			p.control.Paused = true
 		}
+		p.sink.Unlock()
+		p.publish(EventPaused, p.queue.Index(), nil)
 	}
 }
 
-func (p *Player) Next() {
-	p.songDone <- true
+func (p *Player) next() {
+	if !p.isPlaying {
+		return
+	}
+	p.syncTracks()
+	if p.skipToNext() {
+		return
+	}
+	if p.queue.HasNext() {
+		p.queue.Next()
+		p.playNow()
+	} else {
+		p.stop()
+	}
 }
 
-func (p *Player) Previous() {
+func (p *Player) previous() {
+	if !p.isPlaying {
+		if p.queue.HasPrevious() {
+			p.queue.Previous()
+		}
+		return
+	}
+	p.syncTracks()
 	if p.queue.HasPrevious() {
 		p.queue.Previous()
-		p.songDone <- false
 	}
+	p.playNow()
 }
 
-func (p *Player) handleSongEnd() {
-	p.isHandling = true
-	fmt.Println("Starting queue handler")
-handlerLoop:
-	for {
-		advance := <-p.songDone
-		if (advance && p.queue.HasNext()) || (!advance) {
-			if advance {
-				p.queue.Next()
-			}
-			var decodeErr error
-			nowF, nowErr := p.queue.Now()
-			if nowErr != nil {
-				fmt.Println(nowErr)
-			}
-			p.streamer, p.format, decodeErr = decodeAudioFile(nowF)
-			if decodeErr != nil {
-				fmt.Println(decodeErr)
-			} else {
-				targetSR := beep.SampleRate(p.Config.SampleRate)
-				p.streamer = beep.Resample(p.Config.Quality, p.format.SampleRate, targetSR, p.streamer)
-				if !p.isSpeakerInited {
-					p.isSpeakerInited = true
-					speaker.Init(targetSR, targetSR.N(p.Config.BufferedTime))
-				}
-				p.control = &beep.Ctrl{
-					Streamer: p.streamer,
-					Paused:   p.isPaused,
-				}
-				speaker.Clear()
-				speaker.Play(beep.Seq(p.control, beep.Callback(func() { p.songDone <- true })))
-			}
+// replanNext swap out the pre-decoded next track after the play order changes
+func (p *Player) replanNext() {
+	if !p.isPlaying {
+		return
+	}
+	p.followOutput()
+	if !p.isPlaying {
+		return
+	}
+	p.discardNext()
+	p.prepareNext()
+}
+
+// planAppended make sure an item added to the end of the queue is played after the current track when it should be
+func (p *Player) planAppended() {
+	if p.queue.IsShuffled() || p.queue.Repeat() == RepeatAll {
+		p.replanNext() // the new item may now come next
+		return
+	}
+	if !p.isPlaying {
+		return
+	}
+	p.followOutput()
+	p.sink.Lock()
+	isMissing := p.tracks.current != nil && p.tracks.next == nil
+	p.sink.Unlock()
+	if isMissing {
+		p.prepareNext() // the current track was the last one
+	}
+}
+
+// discardNext forget the pre-decoded next track
+func (p *Player) discardNext() {
+	p.sink.Lock()
+	p.tracks.next.close()
+	p.tracks.next = nil
+	p.sink.Unlock()
+}
+
+// Status get a snapshot of the player's state
+func (p *Player) Status() PlayerStatus {
+	return p.do(playerCommand{kind: commandStatus}).status
+}
+
+func (p *Player) status() (status PlayerStatus) {
+	status = PlayerStatus{
+		Playing:      p.isPlaying,
+		Paused:       p.isPaused,
+		Index:        p.queue.Index(),
+		HasNext:      p.queue.HasNext(),
+		HasPrevious:  p.queue.HasPrevious(),
+		MinimumIndex: p.queue.MinimumIndex(),
+		MaximumIndex: p.queue.MaximumIndex(),
+		Shuffle:      p.queue.IsShuffled(),
+		Repeat:       p.queue.Repeat(),
+	}
+	if status.Playing {
+		meta, err := p.queue.Meta(status.Index)
+		if err == nil {
+			status.Current = &meta.Info
+		}
+	}
+	return
+}
+
+// Timeline get what the output is playing and how far into it, all at the same moment
+func (p *Player) Timeline() Timeline {
+	return p.do(playerCommand{kind: commandTimeline}).timeline
+}
+
+func (p *Player) timeline() (tl Timeline) {
+	p.followOutput() // the output may have moved on by itself
+	tl = Timeline{
+		Playing: p.isPlaying,
+		Paused:  p.isPaused,
+		Index:   p.playingIndex,
+		Next:    -1,
+		Buffer:  p.Config.BufferedTime,
+	}
+	if p.queue.Repeat() == RepeatOne {
+		tl.Next = p.playingIndex
+	} else if p.isPlaying {
+		tl.Next = p.queue.NextIndex()
+	}
+	p.sink.Lock()
+	if t := p.currentTrack(); t != nil {
+		tl.Position = t.position()
+		tl.Length = t.rate.D(t.length)
+	}
+	p.sink.Unlock()
+	return
+}
+
+// Entry get information about the queue item at the absolute index
+func (p *Player) Entry(index int) (entry QueueEntry, err error) {
+	entry.Index = index
+	entry.Current = index == p.queue.Index()
+	entry.Location, err = p.queue.Location(index)
+	if err != nil {
+		return
+	}
+	entry.Meta, err = p.queue.Meta(index)
+	return
+}
+
+// Open get a reader of the encoded queue item at the absolute index, which the caller must close
+func (p *Player) Open(index int) (ReadSeekerCloser, error) {
+	return p.queue.Open(index)
+}
+
+// Entries get information about every retrievable queue item, oldest first
+func (p *Player) Entries() []QueueEntry {
+	entries := []QueueEntry{}
+	for i := p.queue.MinimumIndex(); i < p.queue.MaximumIndex(); i++ {
+		entry, err := p.Entry(i)
+		if err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// SetVolume set the output level, as a percentage (0 to 100) of full amplitude
+func (p *Player) SetVolume(level int) error {
+	if level < 0 || level > 100 {
+		return errors.New("VolumeOutOfRange")
+	}
+	p.sink.Lock()
+	p.volumeLevel = level
+	p.applyVolume()
+	p.sink.Unlock()
+	return nil
+}
+
+// Mute silence output without forgetting the volume level
+func (p *Player) Mute() {
+	p.sink.Lock()
+	p.isMuted = true
+	p.applyVolume()
+	p.sink.Unlock()
+}
+
+// Unmute restore output to the volume level
+func (p *Player) Unmute() {
+	p.sink.Lock()
+	p.isMuted = false
+	p.applyVolume()
+	p.sink.Unlock()
+}
+
+// Volume get the output level percentage and whether output is muted
+func (p *Player) Volume() (level int, muted bool) {
+	p.sink.Lock()
+	defer p.sink.Unlock()
+	return p.volumeLevel, p.isMuted
+}
+
+// applyVolume update the gain stage to match the player's volume; the sink must be locked
+func (p *Player) applyVolume() {
+	if p.volume == nil {
+		return
+	}
+	p.volume.Silent = p.isMuted || p.volumeLevel == 0
+	if !p.volume.Silent {
+		// Base^Volume == level/100
+		p.volume.Volume = math.Log2(float64(p.volumeLevel) / 100)
+	}
+}
+
+// currentTrack get the track being played; the sink must be locked
+func (p *Player) currentTrack() *track {
+	if p.tracks == nil {
+		return nil
+	}
+	return p.tracks.current
+}
+
+// Position get the playback position within the current track
+func (p *Player) Position() (time.Duration, error) {
+	p.sink.Lock()
+	defer p.sink.Unlock()
+	t := p.currentTrack()
+	if t == nil {
+		return 0, errors.New("NothingPlaying")
+	}
+	return t.position(), nil
+}
+
+// Length get the total length of the current track
+func (p *Player) Length() (time.Duration, error) {
+	p.sink.Lock()
+	defer p.sink.Unlock()
+	t := p.currentTrack()
+	if t == nil {
+		return 0, errors.New("NothingPlaying")
+	}
+	return t.rate.D(t.length), nil
+}
+
+// Seek move the playback position within the current track
+func (p *Player) Seek(position time.Duration) error {
+	p.sink.Lock()
+	defer p.sink.Unlock()
+	t := p.currentTrack()
+	if t == nil {
+		return errors.New("NothingPlaying")
+	}
+	err := t.seek(position)
+	if err == nil && p.tracks.next != nil {
+		// a crossfade may have already started the next track
+		p.tracks.next.seek(0)
+	}
+	return err
+}
+
+// followOutput catch the queue up with the output moving on from track to track by itself,
+// then carry on once the output runs out of tracks
+func (p *Player) followOutput() {
+	if !p.isPlaying || !p.syncTracks() {
+		return
+	}
+	if p.queue.Repeat() == RepeatOne && p.playingIndex != -1 {
+		p.playNow()
+		return
+	}
+	if !p.queue.HasNext() {
+		p.stop()
+		return
+	}
+	p.queue.Next()
+	p.playNow()
+}
+
+// stop silence the output once there's nothing left to play
+func (p *Player) stop() {
+	p.sink.Lock()
+	p.tracks.current.close()
+	p.tracks.next.close()
+	p.tracks.current = nil
+	p.tracks.next = nil
+	p.tracks.switched = 0
+	p.tracks.ended = false
+	p.sink.Unlock()
+	p.trackChanged(-1)
+	p.isPlaying = false
+	p.publish(EventQueueFinished, p.queue.Index(), nil)
+	fmt.Println("Queue finished, stopping playback")
+}
+
+// startOutput set up the output chain the first time the player plays; it lasts as long as the player
+func (p *Player) startOutput() {
+	if p.tracks != nil {
+		return
+	}
+	targetSR := beep.SampleRate(p.Config.SampleRate)
+	if !p.isSinkInited {
+		initErr := p.sink.Init(targetSR, targetSR.N(p.Config.BufferedTime))
+		if initErr != nil {
+			fmt.Println(initErr)
 		} else {
-			speaker.Clear()
-			p.isHandling = false
-			fmt.Println("Queue finished, shutting down queue handler")
-			break handlerLoop
+			p.isSinkInited = true
 		}
 	}
+	p.sink.Lock()
+	p.tracks = newTrackStreamer(targetSR.N(p.Config.Crossfade))
+	p.control = &beep.Ctrl{
+		Streamer: p.tracks,
+		Paused:   p.isPaused,
+	}
+	p.volume = &effects.Volume{
+		Streamer: p.control,
+		Base:     2,
+	}
+	p.applyVolume()
+	p.sink.Unlock()
+	p.sink.Clear()
+	p.sink.Play(p.volume)
+}
+
+// syncTracks catch the queue up with tracks the output has moved on to by itself.
+// Returns true when the output has run out of tracks.
+func (p *Player) syncTracks() bool {
+	p.sink.Lock()
+	switched, ended := p.tracks.switched, p.tracks.ended
+	p.tracks.switched = 0
+	p.tracks.ended = false
+	p.sink.Unlock()
+	for i := 0; i < switched; i++ {
+		p.queue.Next()
+		p.trackChanged(p.queue.Index())
+	}
+	if switched != 0 && !ended {
+		p.prepareNext()
+	}
+	return ended
+}
+
+// skipToNext move the output on to the pre-decoded next track, if there is one
+func (p *Player) skipToNext() bool {
+	p.sink.Lock()
+	defer p.sink.Unlock()
+	if p.tracks.current == nil || p.tracks.next == nil {
+		return false
+	}
+	p.tracks.advance() // the queue catches up once the player wakes up
+	return true
+}
+
+// playNow decode the queue's current item and play it straight away
+func (p *Player) playNow() {
+	targetSR := beep.SampleRate(p.Config.SampleRate)
+	var t *track
+	nowF, nowErr := p.queue.Now()
+	if nowErr != nil {
+		fmt.Println(nowErr)
+		p.publish(EventDecodeError, p.queue.Index(), nowErr)
+	} else {
+		var decodeErr error
+		t, decodeErr = newTrack(nowF, targetSR, p.Config.Quality)
+		if decodeErr != nil {
+			fmt.Println(decodeErr)
+			p.publish(EventDecodeError, p.queue.Index(), decodeErr)
+		}
+	}
+	p.sink.Lock()
+	p.tracks.current.close()
+	p.tracks.next.close()
+	p.tracks.current = t
+	p.tracks.next = nil
+	if t == nil {
+		// skip over it
+		p.tracks.ended = true
+		p.tracks.notify()
+	}
+	p.sink.Unlock()
+	if t != nil {
+		p.trackChanged(p.queue.Index())
+		p.prepareNext()
+	} else {
+		p.trackChanged(-1)
+	}
 }
 
-func decodeAudioFile(f ReadSeekerCloser) (streamer beep.Streamer, format beep.Format, decodeErr error) {
-	f.Seek(0, 0)
-	var data []byte
-	data, decodeErr = ioutil.ReadAll(f)
+// prepareNext pre-decode the queue's next item, so the output can move on to it without a gap
+func (p *Player) prepareNext() {
+	if p.queue.Repeat() == RepeatOne {
+		return // the current track is played again once it ends
+	}
+	nextF, peekErr := p.queue.PeekNext()
+	if peekErr != nil {
+		return
+	}
+	t, decodeErr := newTrack(nextF, beep.SampleRate(p.Config.SampleRate), p.Config.Quality)
+	if decodeErr != nil {
+		fmt.Println(decodeErr)
+		p.publish(EventDecodeError, p.queue.NextIndex(), decodeErr)
+		return
+	}
+	p.sink.Lock()
+	if p.tracks.current != nil {
+		p.tracks.next.close()
+		p.tracks.next = t
+	} else {
+		t.close()
+	}
+	p.sink.Unlock()
+}
+
+// trackChanged publish the end of the previous track and the start of the track at index (-1 for none)
+func (p *Player) trackChanged(index int) {
+	if p.playingIndex != -1 {
+		p.publish(EventTrackEnded, p.playingIndex, nil)
+	}
+	p.playingIndex = index
+	if index != -1 {
+		p.publish(EventTrackStarted, index, nil)
+	}
+}
+
+// publish send an event about the queue item at index to subscribers
+func (p *Player) publish(eventType EventType, index int, err error) {
+	e := Event{Type: eventType, Index: index}
+	meta, metaErr := p.queue.Meta(index)
+	if metaErr == nil {
+		e.Track = &meta.Info
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.Events.Publish(e)
+}
+
+// decodeAudioFile start decoding f. A decoder which panics on malformed data, as beep's WAV decoder can,
+// gives a DecodePanic error instead of taking the server down.
+func decodeAudioFile(f ReadSeekerCloser) (streamer beep.StreamSeekCloser, format beep.Format, decodeErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			streamer = nil
+			decodeErr = fmt.Errorf("DecodePanic: %v", r)
+		}
+	}()
+	var mime string
+	mime, decodeErr = probeAudioFormat(f)
 	if decodeErr != nil {
 		return
 	}
-	mime := detectAudioType(data)
 	//fmt.Println("File decoded as " + mime)
-	f.Seek(0, 0)
 	switch mime {
-	case "audio/mp3":
+	case MimeMP3:
 		streamer, format, decodeErr = mp3.Decode(f)
-	case "audio/wav":
+	case MimeWav:
 		streamer, format, decodeErr = wav.Decode(f)
-	case "audio/vorbis":
+	case MimeVorbis:
 		streamer, format, decodeErr = vorbis.Decode(f)
-	case "audio/flac":
+	case MimeFLAC:
 		streamer, format, decodeErr = flac.Decode(f)
 	}
 	return
 }
 
-func detectAudioType(data []byte) string {
-	if bytes.Compare(data[0:4], []byte{102, 76, 97, 67}) == 0 { // spells fLaC
-		//fmt.Println("flac")
-		return "audio/flac"
-	}
-	if bytes.Compare(data[0:2], []byte{73, 68}) == 0 {
-		//fmt.Println("mp3")
-		return "audio/mp3"
-	}
-	if bytes.Compare(data[0:4], []byte{82, 73, 70, 70}) == 0 && bytes.Compare(data[8:12], []byte{87, 65, 86, 69}) == 0 { // spells RIFF and WAVE, respectively
-		//fmt.Println("wav")
-		return "audio/wav"
-	}
-	if bytes.Compare(data[29:35], []byte{118, 111, 114, 98, 105, 115}) == 0 { // spells vorbis
-		//fmt.Println("vorbis")
-		return "audio/vorbis"
-	}
-	//fmt.Println("No format detected")
-	return ""
+type PlayerStatus struct {
+	Playing      bool       `json:"playing"`
+	Paused       bool       `json:"paused"`
+	Index        int        `json:"index"`
+	HasNext      bool       `json:"has_next"`
+	HasPrevious  bool       `json:"has_previous"`
+	MinimumIndex int        `json:"minimum_index"`
+	MaximumIndex int        `json:"maximum_index"`
+	Shuffle      bool       `json:"shuffle"`
+	Repeat       RepeatMode `json:"repeat"`
+	Current      *TrackInfo `json:"current,omitempty"`
+}
+
+// Timeline where playback is up to
+type Timeline struct {
+	Playing  bool          `json:"playing"`
+	Paused   bool          `json:"paused"`
+	Index    int           `json:"index"`    // absolute queue index of the track being output, -1 when there isn't one
+	Next     int           `json:"next"`     // absolute queue index played after Index, -1 when there isn't one
+	Position time.Duration `json:"position"` // in nanoseconds
+	Length   time.Duration `json:"length"`   // in nanoseconds
+	Buffer   time.Duration `json:"-"`        // output buffer length, which can change while playing; audio is heard this long after it's played
+}
+
+type QueueEntry struct {
+	Index    int       `json:"index"`
+	Current  bool      `json:"current"`
+	Location string    `json:"location"`
+	Meta     TrackMeta `json:"meta"`
 }
 
 type PlayerConfig struct {
 	BufferedTime time.Duration
 	SampleRate   int64
 	Quality      int
+	Crossfade    time.Duration
 }
 
 type ReadSeekerCloser interface {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/wav"
+)
+
+const (
+	testWavFile = "deleteMeTrack.wav"
+)
+
+var (
+	testTrackFormat = beep.Format{SampleRate: 8000, NumChannels: 2, Precision: 2}
+)
+
+// generateTestTrack encode length worth of silence as an in-memory WAV file
+func generateTestTrack(length time.Duration) ReadSeekerCloser {
+	defer os.Remove(testWavFile)
+	f, err := os.Create(testWavFile)
+	if err != nil {
+		return nil
+	}
+	wav.Encode(f, beep.Silence(testTrackFormat.SampleRate.N(length)), testTrackFormat)
+	f.Close()
+	data, _ := ioutil.ReadFile(testWavFile)
+	return NewWrapCloser(bytes.NewReader(data))
+}
+
+func newTestPlayer() *Player {
+	p := NewPlayer(NewNullSink())
+	p.Config = PlayerConfig{
+		BufferedTime: time.Second / 100,
+		SampleRate:   int64(testTrackFormat.SampleRate),
+		Quality:      1,
+	}
+	p.Init()
+	return p
+}
+
+// waitFor poll condition until it is true or timeout elapses
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	return false
+}
+
+func TestPlayerSeek(t *testing.T) {
+	p := newTestPlayer()
+	if _, err := p.Position(); err == nil {
+		t.Errorf("Expected p.Position() to fail while nothing is playing")
+	}
+	p.Enqueue(generateTestTrack(10 * time.Second))
+	p.Play()
+	if !waitFor(time.Second, func() bool { _, err := p.Position(); return err == nil }) {
+		t.Fatalf("Player did not start playing")
+	}
+	length, _ := p.Length()
+	if length != 10*time.Second {
+		t.Errorf("Expected length of 10s, got %s", length)
+	}
+	if err := p.Seek(5 * time.Second); err != nil {
+		t.Fatalf("p.Seek() raised error %s", err)
+	}
+	position, _ := p.Position()
+	if position < 5*time.Second || position > 6*time.Second {
+		t.Errorf("Expected position near 5s, got %s", position)
+	}
+	if err := p.Seek(time.Minute); err == nil {
+		t.Errorf("Expected p.Seek() past the end to fail")
+	}
+	p.Pause()
+}
+
+func TestPlayerVolumeSurvivesTrackChange(t *testing.T) {
+	p := newTestPlayer()
+	if err := p.SetVolume(101); err == nil {
+		t.Errorf("Expected p.SetVolume(101) to fail")
+	}
+	p.SetVolume(50)
+	p.Mute()
+	p.Enqueue(generateTestTrack(time.Second / 20))
+	p.Enqueue(generateTestTrack(10 * time.Second))
+	p.Play()
+	if !waitFor(2*time.Second, func() bool { return p.Status().Index == 1 }) {
+		t.Fatalf("Player did not advance to second track")
+	}
+	level, muted := p.Volume()
+	if level != 50 || !muted {
+		t.Errorf("Expected volume 50 & muted, got %d & %t", level, muted)
+	}
+	p.Unmute()
+	p.sink.Lock()
+	gain := p.volume.Volume
+	silent := p.volume.Silent
+	p.sink.Unlock()
+	if silent || gain != -1 { // 2^-1 == 50%
+		t.Errorf("Expected gain stage at -1 and not silent, got %f & %t", gain, silent)
+	}
+	p.Pause()
+}
+
+func TestPlayerRepeatOne(t *testing.T) {
+	p := newTestPlayer()
+	events := p.Events.Subscribe()
+	p.Enqueue(generateTestTrack(100 * time.Millisecond))
+	p.Enqueue(generateTestTrack(100 * time.Millisecond))
+	p.SetRepeat(RepeatOne)
+	p.Play()
+	started := 0
+	timeout := time.After(2 * time.Second)
+	for started < 3 {
+		select {
+		case e := <-events:
+			if e.Type != EventTrackStarted {
+				continue
+			}
+			if e.Index != 0 {
+				t.Fatalf("Expected track 0 to repeat, but track %d started", e.Index)
+			}
+			started++
+		case <-timeout:
+			t.Fatalf("Track only started %d times", started)
+		}
+	}
+	p.SetRepeat(RepeatOff)
+	p.Next()
+	if !waitFor(time.Second, func() bool { return p.Status().Index == 1 }) {
+		t.Errorf("Expected p.Next() to move on from a repeating track")
+	}
+}
+
+func TestPlayerNextDecodeError(t *testing.T) {
+	p := NewPlayer(NewNullSink())
+	p.Config = newTestPlayer().Config
+	p.QueueConfig.AudioOnly = false // to get something undecodable into the queue
+	p.Init()
+	defer p.Close()
+	events := p.Events.Subscribe()
+	p.Enqueue(NewWrapCloser(strings.NewReader("not really a song")))
+	p.Enqueue(generateTestTrack(10 * time.Second))
+	p.SetRepeat(RepeatAll)
+	p.Play()
+	// item 0 is skipped, then pre-decoding it again to follow item 1 fails too
+	var failed []int
+	timeout := time.After(2 * time.Second)
+	for len(failed) < 2 {
+		select {
+		case e := <-events:
+			if e.Type == EventDecodeError {
+				failed = append(failed, e.Index)
+			}
+		case <-timeout:
+			t.Fatalf("Only got decode errors for %v", failed)
+		}
+	}
+	if failed[0] != 0 || failed[1] != 0 {
+		t.Errorf("Expected decode errors for item 0 each time, got %v", failed)
+	}
+}
+
+func TestPlayerClose(t *testing.T) {
+	defer func(persist bool, buffer, overcache int) {
+		QueuePersist, QueueBuffer, QueueOvercache = persist, buffer, overcache
+	}(QueuePersist, QueueBuffer, QueueOvercache)
+	QueuePersist, QueueBuffer, QueueOvercache = true, 1, 0
+	p := newTestPlayer()
+	for i := 0; i < 6; i++ {
+		p.Enqueue(generateTestTrack(time.Second))
+	}
+	p.Play()
+	if matches, _ := filepath.Glob(FilenameStart + "*" + FilenameEnd); len(matches) == 0 {
+		t.Fatalf("Expected queue items spilled to disk")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("p.Close() raised error %s", err)
+	}
+	expectNoPersistedFiles(t)
+	if err := p.Close(); err == nil || err.Error() != "PlayerClosed" {
+		t.Errorf("Expected PlayerClosed closing twice, got %v", err)
+	}
+	p.Play() // doesn't block
+}
+
+func TestDecodeMalformedWav(t *testing.T) {
+	// an unknown chunk with a negative size makes beep's WAV decoder panic
+	malformed := []byte("RIFF\x44\x00\x00\x00WAVELIST\xff\xff\xff\xff")
+	malformed = append(malformed, make([]byte, 56)...)
+	streamer, _, err := decodeAudioFile(NewWrapCloser(bytes.NewReader(malformed)))
+	if streamer != nil || err == nil || !strings.HasPrefix(err.Error(), "DecodePanic") {
+		t.Errorf("Expected a decoder panic to be returned as DecodePanic, got %v", err)
+	}
+}
+
+func TestPlayRestoredJournal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomjournal")
+	defer os.RemoveAll(dir)
+	newJournaledPlayer := func() *Player {
+		p := NewPlayer(NewNullSink())
+		p.Config = PlayerConfig{BufferedTime: time.Second / 100, SampleRate: int64(testTrackFormat.SampleRate), Quality: 1}
+		p.QueueConfig.JournalDir = dir
+		p.QueueConfig.SpillDir = dir
+		p.Init()
+		return p
+	}
+	p := newJournaledPlayer()
+	for i := 0; i < 3; i++ {
+		p.Enqueue(generateTestTrack(5 * time.Second))
+	}
+	p.Play()
+	p.Next()
+	if index := p.Timeline().Index; index != 1 {
+		t.Fatalf("Expected to be playing index 1, got %d", index)
+	}
+	p.Close()
+
+	// the track which was playing carries on, rather than the one after it
+	restored := newJournaledPlayer()
+	defer restored.Close()
+	restored.Play()
+	if tl := restored.Timeline(); !tl.Playing || tl.Index != 1 {
+		t.Errorf("Expected restored player to play index 1, got %+v", tl)
+	}
+	restored.Next()
+	if index := restored.Timeline().Index; index != 2 {
+		t.Errorf("Expected next to move on to index 2, got %d", index)
+	}
+}
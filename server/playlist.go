@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PlaylistsDirname = "playlists"
+	PlaylistsPrefix  = "/playlists"
+	playlistFileEnd  = ".json"
+	maxPlaylistName  = 64
+)
+
+// Playlist named list of tracks, which can be loaded into the queue
+type Playlist struct {
+	Name    string          `json:"name"`
+	Updated time.Time       `json:"updated"`
+	Entries []PlaylistEntry `json:"entries"`
+}
+
+// PlaylistEntry track in a playlist
+type PlaylistEntry struct {
+	Path     string  `json:"path"` // library path, or path inside the root directory
+	Title    string  `json:"title,omitempty"`
+	Artist   string  `json:"artist,omitempty"`
+	Album    string  `json:"album,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // seconds
+}
+
+type playlistSummary struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+	Length  int       `json:"length"`
+}
+
+// PlaylistStore playlists saved as files in a directory
+type PlaylistStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewPlaylistStore(dir string) (*PlaylistStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &PlaylistStore{dir: dir}, nil
+}
+
+// validPlaylistName whether name can be used as a playlist name, and so as a filename
+func validPlaylistName(name string) bool {
+	if name == "" || len(name) > maxPlaylistName || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		isAllowed := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(" -_.", c)
+		if !isAllowed {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *PlaylistStore) filename(name string) string {
+	return filepath.Join(s.dir, name+playlistFileEnd)
+}
+
+// List get every saved playlist, by name
+func (s *PlaylistStore) List() ([]playlistSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+playlistFileEnd))
+	if err != nil {
+		return nil, err
+	}
+	summaries := []playlistSummary{}
+	for _, match := range matches {
+		playlist, readErr := s.read(strings.TrimSuffix(filepath.Base(match), playlistFileEnd))
+		if readErr != nil {
+			continue
+		}
+		summaries = append(summaries, playlistSummary{Name: playlist.Name, Updated: playlist.Updated, Length: len(playlist.Entries)})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	return summaries, nil
+}
+
+// Get load the playlist called name
+func (s *PlaylistStore) Get(name string) (Playlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(name)
+}
+
+func (s *PlaylistStore) read(name string) (playlist Playlist, err error) {
+	if !validPlaylistName(name) {
+		return playlist, errors.New("InvalidPlaylistName")
+	}
+	data, err := ioutil.ReadFile(s.filename(name))
+	if os.IsNotExist(err) {
+		return playlist, errors.New("NoSuchPlaylist")
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &playlist)
+	playlist.Name = name
+	return
+}
+
+// Put save a playlist, replacing any with the same name
+func (s *PlaylistStore) Put(playlist Playlist) error {
+	if !validPlaylistName(playlist.Name) {
+		return errors.New("InvalidPlaylistName")
+	}
+	if playlist.Entries == nil {
+		playlist.Entries = []PlaylistEntry{}
+	}
+	data, err := json.MarshalIndent(playlist, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.filename(playlist.Name), data)
+}
+
+// Delete remove the playlist called name
+func (s *PlaylistStore) Delete(name string) error {
+	if !validPlaylistName(name) {
+		return errors.New("InvalidPlaylistName")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.filename(name))
+	if os.IsNotExist(err) {
+		return errors.New("NoSuchPlaylist")
+	}
+	return err
+}
+
+// playlistEntryPath the path a playlist uses for a file on disk: its library path, or its path inside the root directory
+func playlistEntryPath(fullPath string) (string, bool) {
+	if LibraryInst != nil {
+		if track, ok := LibraryInst.TrackByFile(fullPath); ok {
+			return track.Path, true
+		}
+	}
+	root, err := filepath.Abs(RootPath)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// importedPlaylistPath translate a path from an imported playlist file into a playlist path, where possible
+func importedPlaylistPath(entryPath string) string {
+	entryPath = strings.Replace(entryPath, "\\", "/", -1)
+	if fullPath := filepath.FromSlash(entryPath); filepath.IsAbs(fullPath) {
+		if converted, ok := playlistEntryPath(fullPath); ok {
+			return converted
+		}
+	}
+	return strings.TrimPrefix(path.Clean(entryPath), "./")
+}
+
+// resolvePlaylistPath find the file on disk for a playlist path
+func resolvePlaylistPath(entryPath string) (string, error) {
+	if LibraryInst != nil {
+		if track, ok := LibraryInst.TrackByPath(entryPath); ok {
+			return track.fullPath, nil
+		}
+	}
+	fullPath, err := resolveRootPath(entryPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		return "", errors.New("MissingPlaylistTrack")
+	}
+	return fullPath, nil
+}
+
+// checkPlaylistTrack refuse a playlist track which isn't in an allowed audio format;
+// a playlist can name any file inside the root directory, such as the server's own config
+func checkPlaylistTrack(fullPath string) error {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = probeAllowedFormat(file)
+	return err
+}
+
+// snapshotQueue make a playlist of the queue's retrievable items.
+// Items which weren't queued by path, like uploads, can't be referred to and are skipped.
+func snapshotQueue(player *Player, name string) (playlist Playlist, skipped int) {
+	playlist = Playlist{Name: name, Updated: time.Now(), Entries: []PlaylistEntry{}}
+	for _, item := range player.Entries() {
+		entryPath, ok := "", false
+		if item.Meta.Path != "" {
+			entryPath, ok = playlistEntryPath(item.Meta.Path)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		info := item.Meta.Info
+		playlist.Entries = append(playlist.Entries, PlaylistEntry{
+			Path:     entryPath,
+			Title:    info.Title,
+			Artist:   info.Artist,
+			Album:    info.Album,
+			Duration: info.Duration,
+		})
+	}
+	return
+}
+
+// loadPlaylist queue every track in a playlist, returning what was queued and the paths which couldn't be
+func loadPlaylist(player *Player, playlist Playlist) (queued []musicQueued, missing []string) {
+	queued, missing = []musicQueued{}, []string{}
+	for _, entry := range playlist.Entries {
+		fullPath, err := resolvePlaylistPath(entry.Path)
+		if err == nil {
+			err = checkPlaylistTrack(fullPath)
+		}
+		if err != nil {
+			missing = append(missing, entry.Path)
+			continue
+		}
+		index, err := player.EnqueueFile(fullPath)
+		if err != nil {
+			missing = append(missing, entry.Path)
+			continue
+		}
+		queued = append(queued, musicQueued{Name: entry.Path, Index: index})
+	}
+	return
+}
+
+type playlistsBody struct {
+	Playlists []playlistSummary `json:"playlists"`
+}
+
+type playlistSavedBody struct {
+	Playlist Playlist `json:"playlist"`
+	Skipped  int      `json:"skipped"` // queue items which weren't queued by path
+}
+
+type playlistLoadedBody struct {
+	Queued  []musicQueued `json:"queued"`
+	Missing []string      `json:"missing"`
+}
+
+// playlistsHandler manage playlists:
+// GET /playlists, GET/PUT/DELETE /playlists/{name}, POST /playlists/{name}/save & POST /playlists/{name}/load
+func playlistsHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if Playlists == nil {
+		writeError(w, 404, "Playlists are unavailable")
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, PlaylistsPrefix), "/")
+	if rest == "" {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		summaries, err := Playlists.List()
+		if err != nil {
+			writeError(w, 500, "Failed to list playlists: "+err.Error())
+			return
+		}
+		writeJSON(w, 200, playlistsBody{Playlists: summaries})
+		return
+	}
+	name, action := rest, ""
+	if slash := strings.LastIndex(rest, "/"); slash != -1 {
+		name, action = rest[:slash], rest[slash+1:]
+	}
+	if !validPlaylistName(name) {
+		writeError(w, 400, fmt.Sprintf("Invalid playlist name %q; use up to %d letters, digits, spaces, dashes, underscores & dots", name, maxPlaylistName))
+		return
+	}
+	switch action {
+	case "":
+		if !allowMethods(w, r, "GET", "PUT", "DELETE") {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			playlistExportHandler(w, r, name)
+		case "PUT":
+			playlistImportHandler(w, r, name)
+		case "DELETE":
+			err := Playlists.Delete(name)
+			if err != nil {
+				writePlaylistError(w, name, err)
+				return
+			}
+			w.WriteHeader(204)
+		}
+	case "save":
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		playlist, skipped := snapshotQueue(playerOf(r), name)
+		err := Playlists.Put(playlist)
+		if err != nil {
+			writePlaylistError(w, name, err)
+			return
+		}
+		fmt.Printf("Saved queue as playlist %s (%d items skipped)\n", name, skipped)
+		writeJSON(w, 200, playlistSavedBody{Playlist: playlist, Skipped: skipped})
+	case "load":
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		playlist, err := Playlists.Get(name)
+		if err != nil {
+			writePlaylistError(w, name, err)
+			return
+		}
+		if r.FormValue("replace") == "true" {
+			playerOf(r).Clear()
+		}
+		queued, missing := loadPlaylist(playerOf(r), playlist)
+		fmt.Printf("Loaded playlist %s (%d tracks missing)\n", name, len(missing))
+		writeJSON(w, 200, playlistLoadedBody{Queued: queued, Missing: missing})
+	default:
+		writeError(w, 404, fmt.Sprintf("Unknown playlist action %q", action))
+	}
+}
+
+// playlistExportHandler respond with a playlist, in the format asked for (JSON by default)
+func playlistExportHandler(w http.ResponseWriter, r *http.Request, name string) {
+	playlist, err := Playlists.Get(name)
+	if err != nil {
+		writePlaylistError(w, name, err)
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" || format == PlaylistJSON {
+		writeJSON(w, 200, playlist)
+		return
+	}
+	data, err := encodePlaylist(format, playlist)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Unknown playlist format %q; use json, m3u, m3u8, pls or xspf", format))
+		return
+	}
+	contentType := playlistContentTypes[format]
+	if format == PlaylistM3U8 || format == PlaylistM3U {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.Write(data)
+}
+
+// playlistImportHandler save the playlist file in the request body as name
+func playlistImportHandler(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxMemory))
+	if err != nil {
+		writeError(w, 400, "Unable to read playlist: "+err.Error())
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = playlistFormatOf(r.Header.Get("Content-Type"), data)
+	}
+	entries, err := decodePlaylist(format, data)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Invalid %s playlist: %s", format, err))
+		return
+	}
+	playlist := Playlist{Name: name, Updated: time.Now(), Entries: []PlaylistEntry{}}
+	for _, entry := range entries {
+		entry.Path = importedPlaylistPath(entry.Path)
+		playlist.Entries = append(playlist.Entries, entry)
+	}
+	err = Playlists.Put(playlist)
+	if err != nil {
+		writePlaylistError(w, name, err)
+		return
+	}
+	fmt.Printf("Imported %s playlist %s\n", format, name)
+	writeJSON(w, 200, playlist)
+}
+
+func writePlaylistError(w http.ResponseWriter, name string, err error) {
+	switch err.Error() {
+	case "NoSuchPlaylist":
+		writeError(w, 404, fmt.Sprintf("No playlist called %q", name))
+	case "InvalidPlaylistName":
+		writeError(w, 400, fmt.Sprintf("Invalid playlist name %q", name))
+	default:
+		writeError(w, 500, fmt.Sprintf("Playlist %q failed: %s", name, err))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlaylistStore(t *testing.T) {
+	dir := newTestLibraryDir(t)
+	defer os.RemoveAll(dir)
+	store, err := NewPlaylistStore(filepath.Join(dir, PlaylistsDirname))
+	if err != nil {
+		t.Fatalf("NewPlaylistStore() raised error %s", err)
+	}
+	if err = store.Put(testPlaylist); err != nil {
+		t.Fatalf("store.Put() raised error %s", err)
+	}
+	store.Put(Playlist{Name: "focus"})
+	summaries, _ := store.List()
+	if len(summaries) != 2 || summaries[0].Name != "Friday" || summaries[0].Length != 3 || summaries[1].Length != 0 {
+		t.Errorf("Unexpected playlists %+v", summaries)
+	}
+	playlist, err := store.Get("Friday")
+	if err != nil || len(playlist.Entries) != 3 {
+		t.Errorf("store.Get() returned %+v, %v", playlist, err)
+	}
+	if err = store.Delete("Friday"); err != nil {
+		t.Errorf("store.Delete() raised error %s", err)
+	}
+	if _, err = store.Get("Friday"); err == nil || err.Error() != "NoSuchPlaylist" {
+		t.Errorf("Expected NoSuchPlaylist after deleting, got %v", err)
+	}
+	for _, name := range []string{"", "../escape", ".hidden", "a/b", strings.Repeat("x", maxPlaylistName+1)} {
+		if err = store.Put(Playlist{Name: name}); err == nil {
+			t.Errorf("Expected error for playlist name %q", name)
+		}
+	}
+}
+
+func TestPlaylistsHandler(t *testing.T) {
+	dir := newTestLibraryDir(t)
+	defer os.RemoveAll(dir)
+	oldRoot, oldMaxMemory := RootPath, MaxMemory
+	defer func() { RootPath, MaxMemory, LibraryInst, Playlists = oldRoot, oldMaxMemory, nil, nil }()
+	RootPath, MaxMemory = dir, DefaultMaxMemory
+	LibraryInst = NewLibrary([]string{filepath.Join(dir, "rock")})
+	LibraryInst.Scan()
+	Playlists, _ = NewPlaylistStore(filepath.Join(dir, PlaylistsDirname))
+	PlayerInst = newTestPlayer()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	// one library track, one track inside the root & one upload
+	PlayerInst.EnqueueFile(filepath.Join(dir, "rock", "loud.wav"))
+	PlayerInst.EnqueueFile(filepath.Join(dir, "intro.wav"))
+	PlayerInst.Enqueue(generateTestTrack(100))
+
+	rec := doTestRequest(mux, "POST", PlaylistsPrefix+"/Friday/save")
+	var saved playlistSavedBody
+	json.Unmarshal(rec.Body.Bytes(), &saved)
+	if rec.Code != 200 || saved.Skipped != 1 || len(saved.Playlist.Entries) != 2 {
+		t.Fatalf("Unexpected save response %d %s", rec.Code, rec.Body)
+	}
+	if paths := []string{saved.Playlist.Entries[0].Path, saved.Playlist.Entries[1].Path}; paths[0] != "rock/loud.wav" || paths[1] != "intro.wav" {
+		t.Errorf("Expected a library path then a root path, got %v", paths)
+	}
+
+	rec = doTestRequest(mux, "GET", PlaylistsPrefix+"/Friday?format=m3u8")
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "\nrock/loud.wav\n") {
+		t.Fatalf("Unexpected export response %d %s", rec.Code, rec.Body)
+	}
+	exported := rec.Body.String()
+
+	// import it back under another name, with a track by absolute path & one which doesn't exist
+	// & one which isn't audio
+	ioutil.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"tokens": []}`), 0644)
+	body := exported + filepath.Join(dir, "rock", "loud.wav") + "\nmissing.mp3\nsecret.json\n"
+	req := httptest.NewRequest("PUT", PlaylistsPrefix+"/focus", strings.NewReader(body))
+	req.Header.Set("Content-Type", "audio/x-mpegurl")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var imported Playlist
+	json.Unmarshal(rec.Body.Bytes(), &imported)
+	if rec.Code != 200 || len(imported.Entries) != 5 || imported.Entries[2].Path != "rock/loud.wav" {
+		t.Fatalf("Unexpected import response %d %s", rec.Code, rec.Body)
+	}
+
+	rec = doTestRequest(mux, "POST", PlaylistsPrefix+"/focus/load?replace=true")
+	var loaded playlistLoadedBody
+	json.Unmarshal(rec.Body.Bytes(), &loaded)
+	if rec.Code != 200 || len(loaded.Queued) != 3 || !reflect.DeepEqual(loaded.Missing, []string{"missing.mp3", "secret.json"}) {
+		t.Fatalf("Unexpected load response %d %s", rec.Code, rec.Body)
+	}
+	if status := PlayerInst.Status(); status.MaximumIndex-status.MinimumIndex != 3 {
+		t.Errorf("Expected the queue to be replaced by 3 tracks, got %+v", status)
+	}
+
+	rec = doTestRequest(mux, "GET", PlaylistsPrefix)
+	var list playlistsBody
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != 200 || len(list.Playlists) != 2 {
+		t.Errorf("Unexpected playlists response %d %s", rec.Code, rec.Body)
+	}
+	for path, expected := range map[string]int{
+		PlaylistsPrefix + "/nope":               404,
+		PlaylistsPrefix + "/Friday?format=wpl":  400,
+		PlaylistsPrefix + "/Friday/shuffle":     404,
+		PlaylistsPrefix + "/.hidden":            400,
+		PlaylistsPrefix + "/Friday?format=xspf": 200,
+		PlaylistsPrefix + "/Friday?format=pls":  200,
+	} {
+		if rec = doTestRequest(mux, "GET", path); rec.Code != expected {
+			t.Errorf("Expected status %d for %s, got %d", expected, path, rec.Code)
+		}
+	}
+	if rec = doTestRequest(mux, "DELETE", PlaylistsPrefix+"/Friday"); rec.Code != 204 {
+		t.Errorf("Expected status 204 deleting a playlist, got %d", rec.Code)
+	}
+	if rec = doTestRequest(mux, "DELETE", PlaylistsPrefix+"/Friday"); rec.Code != 404 {
+		t.Errorf("Expected status 404 deleting a missing playlist, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PlaylistJSON = "json"
+	PlaylistM3U  = "m3u"
+	PlaylistM3U8 = "m3u8"
+	PlaylistPLS  = "pls"
+	PlaylistXSPF = "xspf"
+)
+
+// playlistContentTypes MIME type of each playlist format
+var playlistContentTypes = map[string]string{
+	PlaylistJSON: "application/json",
+	PlaylistM3U:  "audio/x-mpegurl",
+	PlaylistM3U8: "application/vnd.apple.mpegurl",
+	PlaylistPLS:  "audio/x-scpls",
+	PlaylistXSPF: "application/xspf+xml",
+}
+
+// playlistFormatOf work out the format of a playlist file from its Content-Type, falling back to its contents
+func playlistFormatOf(contentType string, data []byte) string {
+	for format, mime := range playlistContentTypes {
+		if strings.HasPrefix(contentType, mime) {
+			return format
+		}
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/x-mpegurl"), strings.HasPrefix(contentType, "audio/mpegurl"):
+		return PlaylistM3U
+	}
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")))
+	switch {
+	case bytes.HasPrefix(bytes.ToLower(trimmed), []byte("[playlist]")):
+		return PlaylistPLS
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return PlaylistXSPF
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return PlaylistJSON
+	}
+	return PlaylistM3U
+}
+
+// decodePlaylist parse a playlist file; entries' paths are left as written in the file
+func decodePlaylist(format string, data []byte) ([]PlaylistEntry, error) {
+	switch format {
+	case PlaylistJSON:
+		var playlist Playlist
+		err := json.Unmarshal(data, &playlist)
+		return playlist.Entries, err
+	case PlaylistM3U, PlaylistM3U8:
+		return decodeM3U(data)
+	case PlaylistPLS:
+		return decodePLS(data)
+	case PlaylistXSPF:
+		return decodeXSPF(data)
+	}
+	return nil, errors.New("UnknownPlaylistFormat")
+}
+
+// encodePlaylist write a playlist in one of the playlist formats
+func encodePlaylist(format string, playlist Playlist) ([]byte, error) {
+	switch format {
+	case PlaylistJSON:
+		return json.MarshalIndent(playlist, "", "  ")
+	case PlaylistM3U, PlaylistM3U8:
+		return encodeM3U(playlist), nil
+	case PlaylistPLS:
+		return encodePLS(playlist), nil
+	case PlaylistXSPF:
+		return encodeXSPF(playlist)
+	}
+	return nil, errors.New("UnknownPlaylistFormat")
+}
+
+// displayTitle Artist - Title, as players show it
+func (e PlaylistEntry) displayTitle() string {
+	if e.Artist != "" && e.Title != "" {
+		return e.Artist + " - " + e.Title
+	}
+	return e.Title
+}
+
+// setDisplayTitle split Artist - Title back up
+func (e *PlaylistEntry) setDisplayTitle(title string) {
+	parts := strings.SplitN(title, " - ", 2)
+	if len(parts) == 2 {
+		e.Artist, e.Title = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	} else {
+		e.Title = strings.TrimSpace(title)
+	}
+}
+
+// M3U
+
+func encodeM3U(playlist Playlist) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	if playlist.Name != "" {
+		fmt.Fprintf(&buf, "#PLAYLIST:%s\n", playlist.Name)
+	}
+	for _, entry := range playlist.Entries {
+		duration := -1
+		if entry.Duration > 0 {
+			duration = int(math.Round(entry.Duration))
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", duration, entry.displayTitle(), entry.Path)
+	}
+	return buf.Bytes()
+}
+
+func decodeM3U(data []byte) ([]PlaylistEntry, error) {
+	entries := []PlaylistEntry{}
+	var info *PlaylistEntry // from the #EXTINF line before the path
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			info = &PlaylistEntry{}
+			parts := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			// the duration may be followed by attributes, like tvg-id="..."
+			if seconds, err := strconv.ParseFloat(strings.Fields(parts[0] + " ")[0], 64); err == nil && seconds > 0 {
+				info.Duration = seconds
+			}
+			if len(parts) == 2 {
+				info.setDisplayTitle(parts[1])
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := PlaylistEntry{}
+		if info != nil {
+			entry = *info
+			info = nil
+		}
+		entry.Path = line
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// PLS
+
+func encodePLS(playlist Playlist) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[playlist]\n")
+	for i, entry := range playlist.Entries {
+		n := i + 1
+		fmt.Fprintf(&buf, "File%d=%s\n", n, entry.Path)
+		if title := entry.displayTitle(); title != "" {
+			fmt.Fprintf(&buf, "Title%d=%s\n", n, title)
+		}
+		duration := -1
+		if entry.Duration > 0 {
+			duration = int(math.Round(entry.Duration))
+		}
+		fmt.Fprintf(&buf, "Length%d=%d\n", n, duration)
+	}
+	fmt.Fprintf(&buf, "NumberOfEntries=%d\nVersion=2\n", len(playlist.Entries))
+	return buf.Bytes()
+}
+
+func decodePLS(data []byte) ([]PlaylistEntry, error) {
+	byNumber := map[int]*PlaylistEntry{}
+	isPLS := false
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.EqualFold(line, "[playlist]") {
+			isPLS = true
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(key, field))
+		if field == "" || err != nil {
+			continue // NumberOfEntries, Version & anything else
+		}
+		entry, ok := byNumber[n]
+		if !ok {
+			entry = &PlaylistEntry{}
+			byNumber[n] = entry
+		}
+		switch field {
+		case "file":
+			entry.Path = value
+		case "title":
+			entry.setDisplayTitle(value)
+		case "length":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				entry.Duration = seconds
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !isPLS {
+		return nil, errors.New("MissingPLSHeader")
+	}
+	numbers := []int{}
+	for n := range byNumber {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	entries := []PlaylistEntry{}
+	for _, n := range numbers {
+		if byNumber[n].Path != "" {
+			entries = append(entries, *byNumber[n])
+		}
+	}
+	return entries, nil
+}
+
+// XSPF
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// xspfTrackList playlist as read, which accepts files missing the XSPF namespace
+type xspfTrackList struct {
+	Tracks []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+func encodeXSPF(playlist Playlist) ([]byte, error) {
+	doc := xspfPlaylist{Version: "1", Title: playlist.Name}
+	for _, entry := range playlist.Entries {
+		location := (&url.URL{Path: entry.Path}).String() // relative URI
+		doc.Tracks = append(doc.Tracks, xspfTrack{
+			Location: location,
+			Title:    entry.Title,
+			Creator:  entry.Artist,
+			Album:    entry.Album,
+			Duration: int64(math.Round(entry.Duration * 1000)),
+		})
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+func decodeXSPF(data []byte) ([]PlaylistEntry, error) {
+	var doc xspfTrackList
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	entries := []PlaylistEntry{}
+	for _, track := range doc.Tracks {
+		location := strings.TrimSpace(track.Location)
+		if u, parseErr := url.Parse(location); parseErr == nil && (u.Scheme == "" || u.Scheme == "file") {
+			location = u.Path
+		}
+		if location == "" {
+			continue
+		}
+		entries = append(entries, PlaylistEntry{
+			Path:     location,
+			Title:    track.Title,
+			Artist:   track.Creator,
+			Album:    track.Album,
+			Duration: float64(track.Duration) / 1000,
+		})
+	}
+	return entries, nil
+}
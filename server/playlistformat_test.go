@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var (
+	testPlaylist = Playlist{
+		Name: "Friday",
+		Entries: []PlaylistEntry{
+			{Path: "Music/rock/loud song.mp3", Title: "Loud", Artist: "The Band", Album: "Noise", Duration: 183},
+			{Path: "Music/intro.wav", Title: "Intro", Duration: 12},
+			{Path: "uploads/untagged.flac"},
+		},
+	}
+)
+
+func TestPlaylistFormatsRoundTrip(t *testing.T) {
+	for _, format := range []string{PlaylistJSON, PlaylistM3U, PlaylistM3U8, PlaylistPLS, PlaylistXSPF} {
+		data, err := encodePlaylist(format, testPlaylist)
+		if err != nil {
+			t.Fatalf("encodePlaylist(%s) raised error %s", format, err)
+		}
+		if detected := playlistFormatOf("", data); detected != format && !(format == PlaylistM3U8 && detected == PlaylistM3U) {
+			t.Errorf("Expected %s playlist to be detected, got %s", format, detected)
+		}
+		entries, err := decodePlaylist(format, data)
+		if err != nil {
+			t.Fatalf("decodePlaylist(%s) raised error %s", format, err)
+		}
+		expected := testPlaylist.Entries
+		if format != PlaylistJSON && format != PlaylistXSPF {
+			// M3U & PLS only keep Artist - Title
+			expected = append([]PlaylistEntry{}, expected...)
+			expected[0].Album = ""
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Errorf("%s round trip: expected %+v, got %+v", format, expected, entries)
+		}
+	}
+}
+
+func TestDecodeForeignPlaylists(t *testing.T) {
+	cases := []struct {
+		format, data string
+		expected     []PlaylistEntry
+	}{
+		{PlaylistM3U, "\xEF\xBB\xBFsong.mp3\r\n# a comment\r\n\r\n#EXTINF:-1 tvg-id=\"x\",Radio\r\nother.ogg\r\n", []PlaylistEntry{
+			{Path: "song.mp3"},
+			{Path: "other.ogg", Title: "Radio"},
+		}},
+		{PlaylistPLS, "[Playlist]\nNumberOfEntries=2\nFile2=b.mp3\nfile1=a.mp3\nTitle1=A\nLength1=-1\nVersion=2\n", []PlaylistEntry{
+			{Path: "a.mp3", Title: "A"},
+			{Path: "b.mp3"},
+		}},
+		{PlaylistXSPF, `<playlist version="1"><trackList><track><location>file:///srv/music/a%20b.mp3</location><duration>1500</duration></track><track><title>No location</title></track></trackList></playlist>`, []PlaylistEntry{
+			{Path: "/srv/music/a b.mp3", Duration: 1.5},
+		}},
+	}
+	for _, c := range cases {
+		entries, err := decodePlaylist(c.format, []byte(c.data))
+		if err != nil {
+			t.Fatalf("decodePlaylist(%s) raised error %s", c.format, err)
+		}
+		if !reflect.DeepEqual(entries, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.format, c.expected, entries)
+		}
+	}
+	if _, err := decodePlaylist(PlaylistPLS, []byte("File1=a.mp3")); err == nil {
+		t.Errorf("Expected error for PLS without a [playlist] header")
+	}
+	if _, err := decodePlaylist(PlaylistXSPF, []byte("<playlist><trackList>")); err == nil {
+		t.Errorf("Expected error for truncated XSPF")
+	}
+	if _, err := decodePlaylist("wpl", nil); err == nil {
+		t.Errorf("Expected error for unknown playlist format")
+	}
+	if format := playlistFormatOf("audio/x-scpls; charset=utf-8", nil); format != PlaylistPLS {
+		t.Errorf("Expected pls format from Content-Type, got %s", format)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RepeatMode what happens when the queue reaches the end of an item, or of the whole queue
+type RepeatMode string
+
+const (
+	RepeatOff RepeatMode = "off"
+	RepeatOne RepeatMode = "one" // the player replays the current item when it ends; skipping still moves on
+	RepeatAll RepeatMode = "all" // the queue wraps around to the oldest retrievable item after the newest
+)
+
+// ParseRepeatMode convert off, one or all to a RepeatMode
+func ParseRepeatMode(mode string) (RepeatMode, error) {
+	switch RepeatMode(mode) {
+	case RepeatOff, RepeatOne, RepeatAll:
+		return RepeatMode(mode), nil
+	}
+	return RepeatOff, errors.New("UnknownRepeatMode")
+}
+
+// SetShuffle play the upcoming items in a random order, without repeating any, or go back to queue order.
+// Items already played stay where they are in the order, so Previous still works.
+func (rq *RollingQueue) SetShuffle(enabled bool) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if enabled == rq.isShuffled {
+		return
+	}
+	rq.isShuffled = enabled
+	rq.nextOrder = nil
+	if !enabled {
+		rq.order = nil
+		rq.trimKept()
+		return
+	}
+	rq.order = []int{}
+	start := rq.minimumIndex
+	for i := start; i <= rq.currentIndex; i++ {
+		rq.order = append(rq.order, i)
+	}
+	rq.orderPos = len(rq.order) - 1
+	upcoming := rq.random().Perm(rq.maximumIndex - rq.currentIndex - 1)
+	for _, offset := range upcoming {
+		rq.order = append(rq.order, rq.currentIndex+1+offset)
+	}
+}
+
+// IsShuffled get whether the queue is played in a random order
+func (rq *RollingQueue) IsShuffled() bool {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.isShuffled
+}
+
+// SetRepeat change the repeat mode
+func (rq *RollingQueue) SetRepeat(mode RepeatMode) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	rq.repeat = mode
+	rq.nextOrder = nil
+	rq.trimKept()
+}
+
+// Repeat get the repeat mode
+func (rq *RollingQueue) Repeat() RepeatMode {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if rq.repeat == "" {
+		return RepeatOff
+	}
+	return rq.repeat
+}
+
+// keepsItems whether items which have been played must stay retrievable
+func (rq *RollingQueue) keepsItems() bool {
+	return rq.config.PersistToDisk || rq.isShuffled || rq.repeat == RepeatAll
+}
+
+// NextIndex get the absolute index Next would move to, or -1 when there isn't one
+func (rq *RollingQueue) NextIndex() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	index, _ := rq.nextIndex()
+	return index
+}
+
+// nextIndex get the absolute index Next would move to
+func (rq *RollingQueue) nextIndex() (int, bool) {
+	canWrap := rq.repeat == RepeatAll && rq.maximumIndex > rq.minimumIndex
+	if rq.isShuffled {
+		if rq.orderPos+1 < len(rq.order) {
+			return rq.order[rq.orderPos+1], true
+		}
+		if !canWrap {
+			return -1, false
+		}
+		if rq.nextOrder == nil {
+			rq.nextOrder = rq.permutation()
+		}
+		return rq.nextOrder[0], true
+	}
+	if rq.currentIndex+1 < rq.maximumIndex {
+		return rq.currentIndex + 1, true
+	}
+	if canWrap {
+		return rq.minimumIndex, true
+	}
+	return -1, false
+}
+
+// previousIndex get the absolute index Previous would move to
+func (rq *RollingQueue) previousIndex() (int, bool) {
+	if rq.isShuffled {
+		if rq.orderPos > 0 {
+			return rq.order[rq.orderPos-1], true
+		}
+		return -1, false
+	}
+	if (rq.existsInBuffer(rq.currentIndex-1) || rq.keepsItems()) && rq.currentIndex > rq.minimumIndex {
+		return rq.currentIndex - 1, true
+	}
+	return -1, false
+}
+
+// movedNext update the play order after moving on to the next item
+func (rq *RollingQueue) movedNext() {
+	if !rq.isShuffled {
+		return
+	}
+	if rq.orderPos+1 < len(rq.order) {
+		rq.orderPos++
+		return
+	}
+	rq.order, rq.nextOrder, rq.orderPos = rq.nextOrder, nil, 0
+}
+
+// movedPrevious update the play order after moving back to the previous item
+func (rq *RollingQueue) movedPrevious() {
+	if rq.isShuffled {
+		rq.orderPos--
+	}
+}
+
+// orderAppended add a newly appended item somewhere in the upcoming part of the play order
+func (rq *RollingQueue) orderAppended(index int) {
+	if !rq.isShuffled {
+		return
+	}
+	rq.nextOrder = nil
+	pos := rq.orderPos + 1 + rq.random().Intn(len(rq.order)-rq.orderPos)
+	rq.order = append(rq.order, 0)
+	copy(rq.order[pos+1:], rq.order[pos:])
+	rq.order[pos] = index
+}
+
+// permutation shuffle every retrievable item, without starting with the current item
+func (rq *RollingQueue) permutation() []int {
+	perm := rq.random().Perm(rq.maximumIndex - rq.minimumIndex)
+	for i := range perm {
+		perm[i] += rq.minimumIndex
+	}
+	if len(perm) > 1 && perm[0] == rq.currentIndex {
+		last := len(perm) - 1
+		perm[0], perm[last] = perm[last], perm[0]
+	}
+	return perm
+}
+
+func (rq *RollingQueue) random() *rand.Rand {
+	if rq.rand == nil {
+		rq.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rq.rand
+}
+
+// jumpTo move the queue straight to the item at the absolute index, which must be retrievable
+func (rq *RollingQueue) jumpTo(index int) (ReadSeekerCloser, error) {
+	if err := rq.waitForLoads(); err != nil {
+		return nil, err
+	}
+	oldBuffer := rq.memBuffer
+	oldIndex := rq.currentIndex
+	rq.memBuffer = make([]ReadSeekerCloser, len(oldBuffer))
+	rq.currentIndex = index
+	// items in both the old & new window stay in memory, the rest are cached or persisted
+	var spillErr error
+	for i, file := range oldBuffer {
+		itemIndex := oldIndex - rq.config.MemBufferSize + i
+		if file == nil {
+			continue
+		}
+		if rq.existsInBuffer(itemIndex) {
+			rq.memBuffer[rq.indexInBuffer(itemIndex)] = file
+			continue
+		}
+		if !rq.tryCacheInOverflow(itemIndex, file) {
+			err := rq.persist(itemIndex, file)
+			if err != nil && spillErr == nil {
+				spillErr = err
+			}
+		}
+	}
+	for i := index - rq.config.MemBufferSize; i <= index+rq.config.MemBufferSize; i++ {
+		if i < rq.minimumIndex || i >= rq.maximumIndex || rq.memBuffer[rq.indexInBuffer(i)] != nil {
+			continue
+		}
+		file, err := rq.fetch(i)
+		if err != nil && i == index {
+			spillErr = err
+		}
+		rq.memBuffer[rq.indexInBuffer(i)] = file
+	}
+	rq.journalSave()
+	if spillErr != nil {
+		return nil, spillErr
+	}
+	return rq.memBuffer[rq.middleBufferIndex()], nil
+}
+
+// fetch take an item outside the memory buffer out of the overflow cache, or load it from disk
+func (rq *RollingQueue) fetch(index int) (ReadSeekerCloser, error) {
+	if rq.config.EnableOvercache {
+		overflowIndex := rq.overflowIndexOfIndex(index)
+		if overflowIndex != -1 {
+			file := rq.overflowBuffer[overflowIndex]
+			rq.overflowBuffer[overflowIndex] = nil
+			rq.overflowIndexes[overflowIndex] = -1
+			return file, nil
+		}
+	}
+	file, err := rq.peekDisk(index)
+	if err != nil {
+		return nil, err
+	}
+	delete(rq.spillOpen, index)         // the memory buffer owns it now
+	rq.spill.Delete(rq.spillKey(index)) // an open file can still be read once it's removed
+	return file, nil
+}
+
+// peek get an item from wherever it is stored, without moving it
+func (rq *RollingQueue) peek(index int) (ReadSeekerCloser, error) {
+	if rq.existsInBuffer(index) {
+		file := rq.memBuffer[rq.indexInBuffer(index)]
+		if file == nil {
+			// the last move may still be loading it
+			rq.waitForLoads()
+			file = rq.memBuffer[rq.indexInBuffer(index)]
+		}
+		if file == nil {
+			return nil, errors.New("NotLoaded")
+		}
+		return file, nil
+	}
+	if rq.config.EnableOvercache {
+		overflowIndex := rq.overflowIndexOfIndex(index)
+		if overflowIndex != -1 {
+			return rq.overflowBuffer[overflowIndex], nil
+		}
+	}
+	return rq.peekDisk(index)
+}
+
+// peekDisk open a spilled item, to be read where it's stored rather than copied into memory.
+// It's only opened once; the queue closes it when the item is dropped, unless it's loaded into memory first.
+func (rq *RollingQueue) peekDisk(index int) (ReadSeekerCloser, error) {
+	if file, ok := rq.spillOpen[index]; ok {
+		return file, nil
+	}
+	file, err := rq.spill.Get(rq.spillKey(index))
+	if err != nil {
+		return nil, err
+	}
+	rq.spillOpen[index] = file
+	return file, nil
+}
+
+// closeSpilled close the spilled items which are open, or just the ones at the absolute indexes given
+func (rq *RollingQueue) closeSpilled(indexes ...int) {
+	if len(indexes) == 0 {
+		for index := range rq.spillOpen {
+			indexes = append(indexes, index)
+		}
+	}
+	for _, index := range indexes {
+		if file, ok := rq.spillOpen[index]; ok {
+			file.Close()
+			delete(rq.spillOpen, index)
+		}
+	}
+}
+
+// trimKept forget played items which were only kept for shuffle or repeat, once they are no longer needed
+func (rq *RollingQueue) trimKept() {
+	if rq.keepsItems() {
+		return
+	}
+	for rq.minimumIndex < rq.currentIndex-rq.config.MemBufferSize {
+		index := rq.minimumIndex
+		if rq.config.EnableOvercache {
+			overflowIndex := rq.overflowIndexOfIndex(index)
+			if overflowIndex != -1 {
+				rq.overflowBuffer[overflowIndex].Close()
+				rq.overflowBuffer[overflowIndex] = nil
+				rq.overflowIndexes[overflowIndex] = -1
+			}
+		}
+		rq.closeSpilled(index)
+		rq.spill.Delete(rq.spillKey(index))
+		rq.journalDrop(index)
+		rq.minimumIndex++
+	}
+	rq.journalSave()
+}
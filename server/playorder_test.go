@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// itemReader get a function which reads the whole of the queue item returned by a queue movement
+func itemReader(t *testing.T) func(ReadSeekerCloser, error) string {
+	return func(f ReadSeekerCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Queue movement raised error %s", err)
+		}
+		if f == nil {
+			t.Fatalf("Queue movement returned nil file")
+		}
+		f.Seek(0, 0)
+		data, readErr := ioutil.ReadAll(f)
+		if readErr != nil {
+			t.Fatalf("ioutil.ReadAll() raised error %s", readErr)
+		}
+		return string(data)
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	q := NewRollingQueue(nopersist_test_qc)
+	readItem := itemReader(t)
+	defer cleanupDummyFiles()
+	defer q.Close()
+	filenames := generateDummyFiles(10)
+	for _, filename := range filenames[:8] {
+		q.AppendFile(filename)
+	}
+	q.Next()
+	q.SetShuffle(true)
+	// items appended while shuffled join the upcoming order
+	q.AppendFile(filenames[8])
+	q.AppendFile(filenames[9])
+	played := []string{filenames[0]}
+	seen := map[string]bool{filenames[0]: true}
+	for q.HasNext() {
+		peeked := readItem(q.PeekNext())
+		item := readItem(q.Next())
+		if peeked != item {
+			t.Errorf("q.PeekNext() returned %s, but q.Next() moved to %s", peeked, item)
+		}
+		if seen[item] {
+			t.Fatalf("Item %s played twice in one shuffle", item)
+		}
+		seen[item] = true
+		played = append(played, item)
+	}
+	if len(played) != len(filenames) {
+		t.Fatalf("Expected shuffle to play %d items, played %d", len(filenames), len(played))
+	}
+	for i := len(played) - 2; i >= 0; i-- {
+		if item := readItem(q.Previous()); item != played[i] {
+			t.Fatalf("Expected q.Previous() to return %s, got %s", played[i], item)
+		}
+	}
+	if q.HasPrevious() {
+		t.Errorf("Expected no previous item before the first played item")
+	}
+	q.SetShuffle(false)
+	if item := readItem(q.Next()); item != filenames[1] {
+		t.Errorf("Expected queue order after unshuffling, got %s", item)
+	}
+}
+
+func TestRepeatAll(t *testing.T) {
+	q := NewRollingQueue(nopersist_test_qc)
+	readItem := itemReader(t)
+	defer cleanupDummyFiles()
+	defer q.Close()
+	filenames := generateDummyFiles(5)
+	for _, filename := range filenames {
+		q.AppendFile(filename)
+	}
+	q.SetRepeat(RepeatAll)
+	for i := 0; i < 12; i++ {
+		if !q.HasNext() {
+			t.Fatalf("Expected repeat all to always have a next item (count = %d)", i)
+		}
+		if item := readItem(q.Next()); item != filenames[i%len(filenames)] {
+			t.Fatalf("Expected %s, got %s (count = %d)", filenames[i%len(filenames)], item, i)
+		}
+	}
+	if q.MinimumIndex() != 0 {
+		t.Errorf("Expected every item to be kept while repeating, minimum index is %d", q.MinimumIndex())
+	}
+	q.SetRepeat(RepeatOff)
+	for q.HasNext() {
+		q.Next()
+	}
+	if q.MinimumIndex() != q.Index()-nopersist_test_qc.MemBufferSize {
+		t.Errorf("Expected played items to be dropped after repeat is disabled, minimum index is %d", q.MinimumIndex())
+	}
+}
+
+// TestRepeatAllPeekSpilled peek a spilled item again and again, as the player does when it re-plans the next track
+func TestRepeatAllPeekSpilled(t *testing.T) {
+	q, filenames := newEditTestQueue(full_test_qc, 12, 11)
+	defer cleanupDummyFiles()
+	defer q.Close()
+	q.SetRepeat(RepeatAll)
+	if location, _ := q.Location(0); location != "disk" {
+		t.Fatalf("Expected item 0 to be spilled, it is in %s", location)
+	}
+	first, err := q.PeekNext()
+	if err != nil {
+		t.Fatalf("PeekNext() raised error %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		if again, _ := q.PeekNext(); again != first {
+			t.Fatalf("Expected the spilled item to be opened once, peek %d opened it again", i)
+		}
+	}
+	if len(q.spillOpen) != 1 {
+		t.Errorf("Expected 1 spilled item open, got %d", len(q.spillOpen))
+	}
+	now, err := q.Next()
+	if now != first || err != nil || len(q.spillOpen) != 0 {
+		t.Errorf("Expected the queue to move onto the item it opened to peek, with nothing left open (error %v)", err)
+	}
+	if item := itemReader(t)(now, err); item != filenames[0] {
+		t.Errorf("Expected %s, got %s", filenames[0], item)
+	}
+}
+
+func TestShuffleRepeatAll(t *testing.T) {
+	q := NewRollingQueue(nopersist_test_qc)
+	readItem := itemReader(t)
+	defer cleanupDummyFiles()
+	defer q.Close()
+	filenames := generateDummyFiles(6)
+	for _, filename := range filenames {
+		q.AppendFile(filename)
+	}
+	q.SetShuffle(true)
+	q.SetRepeat(RepeatAll)
+	for cycle := 0; cycle < 3; cycle++ {
+		seen := map[string]bool{}
+		for i := range filenames {
+			item := readItem(q.Next())
+			if seen[item] {
+				t.Fatalf("Item %s played twice in cycle %d (count = %d)", item, cycle, i)
+			}
+			seen[item] = true
+		}
+	}
+}
+
+func TestParseRepeatMode(t *testing.T) {
+	for _, mode := range []string{"off", "one", "all"} {
+		if parsed, err := ParseRepeatMode(mode); err != nil || string(parsed) != mode {
+			t.Errorf("ParseRepeatMode(%q) returned %s, %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseRepeatMode("sometimes"); err == nil {
+		t.Errorf("Expected error for unknown repeat mode")
+	}
+}
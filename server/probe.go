@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	MimeMP3    = "audio/mp3"
+	MimeWav    = "audio/wav"
+	MimeVorbis = "audio/vorbis"
+	MimeFLAC   = "audio/flac"
+
+	probeHeaderSize = 64 // enough for every signature, including an Ogg page header & first packet
+
+	DefaultFormats = "mp3,wav,vorbis,flac"
+)
+
+// allowedFormats set of MIME types which may be queued; every supported format when nil
+var allowedFormats atomic.Value
+
+// UnsupportedFormatError audio data which none of the decoders can handle
+type UnsupportedFormatError struct {
+	Reason string
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return "UnsupportedFormat: " + e.Reason
+}
+
+// probeAudioFormat identify the format of an audio file from its first bytes, returning its MIME type.
+// An ID3v2 tag is skipped over so the audio after it can be probed too.
+// The file's position is reset afterwards.
+func probeAudioFormat(file io.ReadSeeker) (string, error) {
+	defer file.Seek(0, io.SeekStart)
+	header, err := readHeaderAt(file, 0)
+	if err != nil {
+		return "", err
+	}
+	if tagEnd := id3v2End(header); tagEnd != 0 {
+		afterTag, err := readHeaderAt(file, tagEnd)
+		if err != nil {
+			return "", err
+		}
+		if len(afterTag) == 0 {
+			return "", &UnsupportedFormatError{Reason: "ID3 tag without audio"}
+		}
+		if bytes.HasPrefix(afterTag, []byte("fLaC")) {
+			return MimeFLAC, nil
+		}
+		if isMPEGFrame(afterTag) {
+			return MimeMP3, nil
+		}
+		return "", &UnsupportedFormatError{Reason: "ID3 tag is not followed by MPEG or FLAC audio"}
+	}
+	return probeAudioHeader(header)
+}
+
+// id3v2End the offset of the audio after an ID3v2 tag at the start of header, or 0 when there isn't one
+func id3v2End(header []byte) int64 {
+	if len(header) < 10 || !bytes.HasPrefix(header, []byte("ID3")) {
+		return 0
+	}
+	tagEnd := int64(10 + syncsafe(header[6:10]))
+	if header[5]&0x10 != 0 { // footer present
+		tagEnd += 10
+	}
+	return tagEnd
+}
+
+func readHeaderAt(file io.ReadSeeker, offset int64) ([]byte, error) {
+	_, err := file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, probeHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// probeAudioHeader identify the format of audio data from its first bytes, returning its MIME type
+func probeAudioHeader(header []byte) (string, error) {
+	if len(header) < 4 {
+		return "", &UnsupportedFormatError{Reason: "too short to identify"}
+	}
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return MimeFLAC, nil
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return MimeMP3, nil // tag contents are checked by probeAudioFormat
+	case bytes.HasPrefix(header, []byte("RIFF")):
+		if len(header) >= 12 && string(header[8:12]) == "WAVE" {
+			return MimeWav, nil
+		}
+		return "", &UnsupportedFormatError{Reason: "RIFF file is not WAVE"}
+	case bytes.HasPrefix(header, []byte("OggS")):
+		if isOggVorbis(header) {
+			return MimeVorbis, nil
+		}
+		return "", &UnsupportedFormatError{Reason: "Ogg stream is not Vorbis"}
+	case isMPEGFrame(header):
+		return MimeMP3, nil
+	}
+	return "", &UnsupportedFormatError{Reason: "unrecognised signature"}
+}
+
+// isOggVorbis check the first packet of an Ogg page is a Vorbis identification header
+func isOggVorbis(page []byte) bool {
+	if len(page) < 27 {
+		return false
+	}
+	packetStart := 27 + int(page[26])
+	if len(page) < packetStart+7 {
+		return false
+	}
+	return page[packetStart] == 1 && string(page[packetStart+1:packetStart+7]) == "vorbis"
+}
+
+// isMPEGFrame check for a valid MPEG audio layer III frame header (frame sync 0xFFE)
+func isMPEGFrame(header []byte) bool {
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return false
+	}
+	version := (header[1] >> 3) & 0x03
+	layer := (header[1] >> 1) & 0x03
+	bitrate := header[2] >> 4
+	sampleRate := (header[2] >> 2) & 0x03
+	return version != 1 && // reserved
+		layer == 1 && // layer III
+		bitrate != 0x0F && // bad bitrate
+		sampleRate != 0x03 // reserved
+}
+
+// parseAllowedFormats turn a comma-separated list of format names, like mp3,flac, into a set of MIME types
+func parseAllowedFormats(names string) (map[string]bool, error) {
+	formats := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		mime := "audio/" + name
+		switch mime {
+		case MimeMP3, MimeWav, MimeVorbis, MimeFLAC:
+			formats[mime] = true
+		default:
+			return nil, errors.New("UnknownFormat " + name)
+		}
+	}
+	if len(formats) == 0 {
+		return nil, nil // allow everything
+	}
+	return formats, nil
+}
+
+// setAllowedFormats change which formats may be queued; safe while serving
+func setAllowedFormats(formats map[string]bool) {
+	allowedFormats.Store(formats)
+}
+
+// checkAllowedFormat error when mime is a format the server has been told to refuse
+func checkAllowedFormat(mime string) error {
+	formats, ok := allowedFormats.Load().(map[string]bool)
+	if !ok || formats == nil || formats[mime] {
+		return nil
+	}
+	return &UnsupportedFormatError{Reason: mime + " is not allowed on this server"}
+}
+
+// probeAllowedFormat probeAudioFormat, also refusing formats which aren't allowed
+func probeAllowedFormat(file io.ReadSeeker) (string, error) {
+	mime, err := probeAudioFormat(file)
+	if err != nil {
+		return mime, err
+	}
+	return mime, checkAllowedFormat(mime)
+}
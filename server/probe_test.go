@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProbeAudioFormat(t *testing.T) {
+	id3 := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0}
+	oggVorbis := append([]byte("OggS"), make([]byte, 22)...)
+	oggVorbis = append(oggVorbis, 1, 30, 1)
+	oggVorbis = append(oggVorbis, "vorbis"...)
+	oggOpus := append([]byte("OggS"), make([]byte, 22)...)
+	oggOpus = append(oggOpus, 1, 19)
+	oggOpus = append(oggOpus, "OpusHead"...)
+	cases := []struct {
+		name string
+		data []byte
+		mime string
+	}{
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), MimeFLAC},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), MimeWav},
+		{"vorbis", oggVorbis, MimeVorbis},
+		{"mp3 with ID3", append(id3, 0xFF, 0xFB, 0x90, 0x64), MimeMP3},
+		{"mp3 frame sync", []byte{0xFF, 0xFB, 0x90, 0x64, 0x00}, MimeMP3},
+		{"flac with ID3", append(id3, "fLaC"...), MimeFLAC},
+		{"empty", []byte{}, ""},
+		{"short", []byte("ID"), ""},
+		{"short ogg", []byte("OggS\x00"), ""},
+		{"opus", oggOpus, ""},
+		{"riff avi", []byte("RIFF\x24\x00\x00\x00AVI LIST"), ""},
+		{"mp2 frame sync", []byte{0xFF, 0xFD, 0x90, 0x64}, ""},
+		{"ID3 only", id3[:10], ""},
+		{"text", []byte("not really a song"), ""},
+	}
+	for _, c := range cases {
+		mime, err := probeAudioFormat(bytes.NewReader(c.data))
+		if mime != c.mime {
+			t.Errorf("%s: expected %q, got %q", c.name, c.mime, mime)
+		}
+		if c.mime == "" {
+			if _, ok := err.(*UnsupportedFormatError); !ok {
+				t.Errorf("%s: expected UnsupportedFormatError, got %v", c.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+	}
+}
@@ -3,12 +3,14 @@
 package main
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -25,24 +27,56 @@ type QueueConfig struct {
 	MemBufferSize   int
 	EnableOvercache bool
 	OvercacheSize   int
-	LoadTimeout     time.Duration
-}
-
-// RollingQueue file queue where items roll off the end
+	LoadTimeout     time.Duration // longest to wait for a background load; 0 waits as long as it takes
+	JournalDir      string        // directory to journal the queue in, so it can be restored; empty to disable
+	Spill           BlobStore     // where items which don't fit in memory go; when nil, one is made from the settings below
+	SpillDir        string        // directory items are spilled to, as FilenameStart<index>FilenameEnd; the working directory when empty
+	SpillInMemory   bool          // spill items to memory instead of disk
+	SpillQuota      int64         // most bytes spilled at once; 0 for no limit
+	AudioOnly       bool          // refuse items which aren't in an allowed audio format
+}
+
+// TrackMeta information recorded about a queue item when it is appended
+type TrackMeta struct {
+	Size  int64     `json:"size"`
+	Type  string    `json:"type"`
+	Added time.Time `json:"added"`
+	Info  TrackInfo `json:"info"`
+	Path  string    `json:"-"` // file the item was appended from, if it was appended by path
+}
+
+// RollingQueue file queue where items roll off the end.
+// It is safe for concurrent use; every exported method holds mu.
 type RollingQueue struct {
+	mu              sync.Mutex
+	loaded          *sync.Cond // broadcast when a background load finishes
+	loading         int        // background loads in progress
 	currentIndex    int
 	maximumIndex    int                // maximum enqueued item
 	minimumIndex    int                // minimum equeued item
 	memBuffer       []ReadSeekerCloser // middle item is the current index
 	overflowBuffer  []ReadSeekerCloser // overflow cache for upcoming files
 	overflowIndexes []int              // overflow cache files' absolute queue index
+	meta            []TrackMeta        // per-item metadata, by absolute index
+	journalTracks   []journalTrack     // retrievable items, as recorded in the journal
+	journalErr      error              // problem encountered restoring the journal
+	isRestoring     bool
+	events          *EventBus // where enqueued events are published; nil to not publish them
+	isShuffled      bool
+	repeat          RepeatMode
+	order           []int // play order of absolute indexes, while shuffled
+	orderPos        int   // position of the current item in order
+	nextOrder       []int // play order after order wraps around, once it's been decided
+	rand            *rand.Rand
+	spill           BlobStore
+	spillOpen       map[int]ReadSeekerCloser // spilled items opened to be read where they're stored, by absolute index
+	copies          int                      // AppendCopy calls so far, to give each copy its own spill key
 	config          QueueConfig
-	loadSyncChan    chan bool
 }
 
-func NewRollingQueue(qc QueueConfig) (rq RollingQueue) {
-	rq.loadSyncChan = make(chan bool)
-	rq.config = qc
+func NewRollingQueue(qc QueueConfig) (rq *RollingQueue) {
+	rq = &RollingQueue{config: qc}
+	rq.loaded = sync.NewCond(&rq.mu)
 	// config integrity checks
 	// rq.config.MemBufferSize must be >= 1
 	if rq.config.MemBufferSize < 1 {
@@ -70,11 +104,59 @@ func NewRollingQueue(qc QueueConfig) (rq RollingQueue) {
 			rq.overflowIndexes = append(rq.overflowIndexes, -1)
 		}
 	}
+	rq.spill = qc.Spill
+	if rq.spill == nil {
+		rq.spill = newSpillStore(rq.config)
+	}
+	rq.spillOpen = map[int]ReadSeekerCloser{}
 	rq.currentIndex = -1
-	go rq.loadComplete(true)
+	rq.mu.Lock()
+	rq.journalErr = rq.journalRestore()
+	rq.mu.Unlock()
 	return
 }
 
+// newSpillStore the BlobStore described by qc, falling back to memory when the spill directory can't be used
+func newSpillStore(qc QueueConfig) BlobStore {
+	if !qc.SpillInMemory {
+		store, err := NewFileBlobStore(qc.SpillDir, qc.FilenameStart, qc.SpillQuota)
+		if err == nil {
+			return store
+		}
+		fmt.Println("Spilling queue items to memory, since " + qc.SpillDir + " is unusable: " + err.Error())
+	}
+	return NewMemoryBlobStore(qc.SpillQuota)
+}
+
+// clearStaleSpills remove items spilled to dir, and to the rooms' directories within it, by a server which didn't close cleanly.
+// Queues leave this alone when they start, since another player's queue may already be spilling there; call it once at startup.
+func clearStaleSpills(dir string) {
+	roomDirs, _ := filepath.Glob(filepath.Join(dir, RoomsDirname, "*"))
+	for _, spillDir := range append([]string{dir}, roomDirs...) {
+		store, err := NewFileBlobStore(spillDir, FilenameStart, 0)
+		if err == nil {
+			err = store.Clear()
+		}
+		if err != nil {
+			fmt.Println("Unable to clean up spilled queue items in " + spillDir + ": " + err.Error())
+		}
+	}
+}
+
+// SetEventBus publish an event on bus whenever an item is appended
+func (rq *RollingQueue) SetEventBus(bus *EventBus) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	rq.events = bus
+}
+
+// JournalErr get the error encountered while restoring the queue from its journal, if any
+func (rq *RollingQueue) JournalErr() error {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.journalErr
+}
+
 // utility
 // indexInBuffer translate an absolute index to a memory buffer location
 func (rq *RollingQueue) indexInBuffer(index int) int {
@@ -97,17 +179,52 @@ func (rq *RollingQueue) middleBufferIndex() int {
 	return rq.config.MemBufferSize
 }
 
-func (rq *RollingQueue) generateFilename(index int) string {
-	return rq.config.FilenameStart + strconv.Itoa(index) + rq.config.FilenameEnd
+// spillKey the key the item at the absolute index is spilled under
+func (rq *RollingQueue) spillKey(index int) string {
+	return strconv.Itoa(index) + rq.config.FilenameEnd
 }
 
 // file load sync
-func (rq *RollingQueue) loadComplete(success bool) {
-	rq.loadSyncChan <- success
-}
-
-func (rq *RollingQueue) waitForLoadComplete() bool {
-	return <-rq.loadSyncChan
+// loadInBackground start loading the item at the absolute index into the memory buffer; mu must be held
+func (rq *RollingQueue) loadInBackground(index int) {
+	rq.loading++
+	go rq.loadIndex(index)
+}
+
+func (rq *RollingQueue) loadIndex(index int) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	// the window doesn't move until loads finish, so the slot is still there
+	file, err := rq.fetch(index)
+	if err == nil && rq.existsInBuffer(index) {
+		rq.memBuffer[rq.indexInBuffer(index)] = file
+	}
+	rq.loading--
+	rq.loaded.Broadcast()
+}
+
+// waitForLoads wait until no background loads are in progress; mu must be held
+func (rq *RollingQueue) waitForLoads() error {
+	if rq.loading == 0 {
+		return nil
+	}
+	var deadline time.Time
+	if rq.config.LoadTimeout > 0 {
+		deadline = time.Now().Add(rq.config.LoadTimeout)
+		timer := time.AfterFunc(rq.config.LoadTimeout, func() {
+			rq.mu.Lock()
+			rq.loaded.Broadcast()
+			rq.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for rq.loading > 0 {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return errors.New("LoadTimeout")
+		}
+		rq.loaded.Wait()
+	}
+	return nil
 }
 
 // persistence
@@ -115,54 +232,17 @@ func (rq *RollingQueue) persistIfConfig(index int, file ReadSeekerCloser) error
 	if rq.config.PersistToDisk {
 		return rq.persist(index, rq.memBuffer[0])
 	}
+	if rq.keepsItems() && rq.memBuffer[0] != nil && !rq.tryCacheInOverflow(index, rq.memBuffer[0]) {
+		return rq.persist(index, rq.memBuffer[0])
+	}
 	return nil
 }
 
-func (rq *RollingQueue) persist(index int, file ReadSeekerCloser) (err error) {
+func (rq *RollingQueue) persist(index int, file ReadSeekerCloser) error {
 	//fmt.Printf("Persisting %d\n", index)
-	var data []byte
-	var diskFile *os.File
+	defer file.Close()
 	file.Seek(0, 0)
-	data, err = ioutil.ReadAll(file)
-	if err != nil {
-		return
-	}
-	file.Close()
-	diskFile, err = os.Create(rq.generateFilename(index))
-	if err != nil {
-		return
-	}
-	defer diskFile.Close()
-	_, err = diskFile.Write(data)
-	return
-}
-
-func (rq *RollingQueue) loadIndexInto(index, bufferIndex int) {
-	if rq.config.EnableOvercache {
-		overflowIndex := rq.overflowIndexOfIndex(index)
-		if overflowIndex != -1 {
-			rq.memBuffer[bufferIndex] = rq.overflowBuffer[overflowIndex]
-			rq.overflowBuffer[overflowIndex] = nil
-			rq.overflowIndexes[overflowIndex] = -1
-			go rq.loadComplete(true)
-			return
-		}
-	}
-	filename := rq.generateFilename(index)
-	diskFile, openErr := os.Open(filename)
-	if openErr != nil {
-		go rq.loadComplete(false)
-		return
-	}
-	newRSC, copyErr := copyReader(diskFile)
-	diskFile.Close()
-	if copyErr != nil {
-		go rq.loadComplete(false)
-		return
-	}
-	rq.memBuffer[bufferIndex] = newRSC
-	go rq.loadComplete(true)
-	os.Remove(filename) // remove file once it's successfully loaded
+	return rq.spill.Put(rq.spillKey(index), file)
 }
 
 // caching
@@ -215,6 +295,12 @@ func (rq *RollingQueue) cacheInOverflow(file ReadSeekerCloser, index, overflowIn
 
 // TryCacheInOverflow try to add file to overflow. Returns true on success, false otherwise (ie when buffer is full)
 func (rq *RollingQueue) TryCacheInOverflow(index int, file ReadSeekerCloser) bool {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.tryCacheInOverflow(index, file)
+}
+
+func (rq *RollingQueue) tryCacheInOverflow(index int, file ReadSeekerCloser) bool {
 	overflowIndex := rq.emptyOverflowIndex()
 	if overflowIndex != -1 {
 		rq.cacheInOverflow(file, index, overflowIndex)
@@ -223,61 +309,108 @@ func (rq *RollingQueue) TryCacheInOverflow(index int, file ReadSeekerCloser) boo
 	return false
 }
 
-// Next move the queue to the next item and returns that item
+// Next move the queue to the next item (in play order) and returns that item
 // returns nil if the next item does not exist
 func (rq *RollingQueue) Next() (ReadSeekerCloser, error) {
-	if !rq.HasNext() {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.next()
+}
+
+func (rq *RollingQueue) next() (file ReadSeekerCloser, err error) {
+	target, ok := rq.nextIndex()
+	if !ok {
 		return nil, errors.New("NoNextItem")
 	}
-	if !rq.waitForLoadComplete() {
-		go rq.loadComplete(false)
-		return nil, errors.New("LoadFailure")
+	if target == rq.currentIndex+1 {
+		file, err = rq.stepForward()
+	} else {
+		file, err = rq.jumpTo(target)
+	}
+	if rq.currentIndex == target {
+		rq.movedNext()
+	}
+	return
+}
+
+// stepForward move the memory buffer along by one item
+func (rq *RollingQueue) stepForward() (ReadSeekerCloser, error) {
+	if err := rq.waitForLoads(); err != nil {
+		return nil, err
 	}
 	// persist previous item that will roll off the memBuffer
-	if (rq.currentIndex - rq.config.MemBufferSize) >= 0 {
+	if (rq.currentIndex - rq.config.MemBufferSize) >= rq.minimumIndex {
 		err := rq.persistIfConfig(rq.currentIndex-rq.config.MemBufferSize, rq.memBuffer[0])
 		if err != nil {
 			return nil, err
 		}
-		if !rq.config.PersistToDisk {
+		if !rq.keepsItems() {
+			rq.journalDrop(rq.minimumIndex)
 			rq.minimumIndex++
 		}
 		//fmt.Printf("Minimum index is now %d\n", rq.minimumIndex)
 	}
 	rq.shiftLeft()
 	rq.currentIndex++
-	start := time.Now()
+	rq.journalSave()
 	if (rq.currentIndex + rq.config.MemBufferSize) < rq.maximumIndex {
-		go rq.loadIndexInto(rq.currentIndex+rq.config.MemBufferSize, rq.highestBufferIndex())
-	} else {
-		go rq.loadComplete(true)
-	}
-	//loadWaitLoop:
-	for {
-		if rq.memBuffer[rq.middleBufferIndex()] != nil {
-			return rq.memBuffer[rq.middleBufferIndex()], nil
-		} else if time.Since(start) >= rq.config.LoadTimeout {
-			return nil, errors.New("LoadTimeout")
-		}
+		rq.loadInBackground(rq.currentIndex + rq.config.MemBufferSize)
 	}
+	return rq.nowLoaded()
+}
+
+// PeekNext get the next item (in play order) without moving the queue
+func (rq *RollingQueue) PeekNext() (ReadSeekerCloser, error) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	target, ok := rq.nextIndex()
+	if !ok {
+		return nil, errors.New("NoNextItem")
+	}
+	if target == rq.currentIndex {
+		return nil, errors.New("NextIsCurrent") // one item repeating; it can't be read twice at once
+	}
+	return rq.peek(target)
 }
 
 func (rq *RollingQueue) HasNext() bool {
-	return rq.maximumIndex > rq.currentIndex+1
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	_, ok := rq.nextIndex()
+	return ok
 }
 
 func (rq *RollingQueue) Previous() (ReadSeekerCloser, error) {
-	if !rq.HasPrevious() {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.previous()
+}
+
+func (rq *RollingQueue) previous() (file ReadSeekerCloser, err error) {
+	target, ok := rq.previousIndex()
+	if !ok {
 		return nil, errors.New("NoPreviousItem")
 	}
-	if !rq.waitForLoadComplete() {
-		go rq.loadComplete(false)
-		return nil, errors.New("LoadFailure")
+	if target == rq.currentIndex-1 {
+		file, err = rq.stepBack()
+	} else {
+		file, err = rq.jumpTo(target)
+	}
+	if rq.currentIndex == target {
+		rq.movedPrevious()
+	}
+	return
+}
+
+// stepBack move the memory buffer back by one item
+func (rq *RollingQueue) stepBack() (ReadSeekerCloser, error) {
+	if err := rq.waitForLoads(); err != nil {
+		return nil, err
 	}
 	var err error
-	if rq.currentIndex+rq.config.MemBufferSize < rq.maximumIndex {
+	if rq.currentIndex+rq.config.MemBufferSize < rq.maximumIndex && rq.memBuffer[rq.highestBufferIndex()] != nil {
 		// persist upcoming item that will roll off the memBuffer
-		overflowSuccess := rq.TryCacheInOverflow(rq.config.MemBufferSize+rq.currentIndex, rq.memBuffer[rq.highestBufferIndex()])
+		overflowSuccess := rq.tryCacheInOverflow(rq.config.MemBufferSize+rq.currentIndex, rq.memBuffer[rq.highestBufferIndex()])
 		if !overflowSuccess {
 			err = rq.persist(rq.config.MemBufferSize+rq.currentIndex, rq.memBuffer[rq.highestBufferIndex()])
 		}
@@ -287,94 +420,253 @@ func (rq *RollingQueue) Previous() (ReadSeekerCloser, error) {
 	}
 	rq.shiftRight()
 	rq.currentIndex--
-	start := time.Now()
-	if (rq.currentIndex-rq.config.MemBufferSize) >= 0 && rq.config.PersistToDisk {
-		go rq.loadIndexInto(rq.currentIndex-rq.config.MemBufferSize, 0)
-	} else {
-		go rq.loadComplete(true)
-	}
-	//loadWaitLoop:
-	for {
-		if rq.memBuffer[rq.middleBufferIndex()] != nil {
-			return rq.memBuffer[rq.middleBufferIndex()], nil
-		} else if time.Since(start) >= rq.config.LoadTimeout {
-			return nil, errors.New("LoadTimeout")
-		}
+	rq.journalSave()
+	if (rq.currentIndex-rq.config.MemBufferSize) >= rq.minimumIndex && rq.keepsItems() {
+		rq.loadInBackground(rq.currentIndex - rq.config.MemBufferSize)
+	}
+	return rq.nowLoaded()
+}
+
+// nowLoaded get the current item after stepping, which was already loaded as a neighbour
+func (rq *RollingQueue) nowLoaded() (ReadSeekerCloser, error) {
+	file := rq.memBuffer[rq.middleBufferIndex()]
+	if file == nil {
+		return nil, errors.New("NotLoaded")
 	}
+	return file, nil
 }
 
 func (rq *RollingQueue) HasPrevious() bool {
-	return (rq.existsInBuffer(rq.currentIndex-1) || rq.config.PersistToDisk) && rq.currentIndex > rq.minimumIndex
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	_, ok := rq.previousIndex()
+	return ok
 }
 
 // Now get the current queue item
 func (rq *RollingQueue) Now() (ReadSeekerCloser, error) {
-	if !rq.HasNow() {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if rq.currentIndex == -1 {
 		return nil, errors.New("NoCurrentItem")
 	}
 	return rq.memBuffer[rq.middleBufferIndex()], nil
 }
 
 func (rq *RollingQueue) HasNow() bool {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
 	return rq.currentIndex != -1
 }
 
 // Index get the absolute index of the current item
 func (rq *RollingQueue) Index() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
 	return rq.currentIndex
 }
 
-func (rq *RollingQueue) Append(file ReadSeekerCloser) (err error) {
+// MinimumIndex get the absolute index of the oldest item still retrievable
+func (rq *RollingQueue) MinimumIndex() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.minimumIndex
+}
+
+// MaximumIndex get the absolute index after the newest item (ie the amount of items ever appended)
+func (rq *RollingQueue) MaximumIndex() int {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.maximumIndex
+}
+
+// Location get where the item at the absolute index is stored; one of memory, overflow or disk
+func (rq *RollingQueue) Location(index int) (string, error) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if index < rq.minimumIndex || index >= rq.maximumIndex {
+		return "", errors.New("IndexOutOfRange")
+	}
+	if rq.existsInBuffer(index) && rq.memBuffer[rq.indexInBuffer(index)] != nil {
+		return "memory", nil
+	}
+	if rq.config.EnableOvercache && rq.existsIndexInOverflow(index) {
+		return "overflow", nil
+	}
+	return "disk", nil
+}
+
+// isSpilled whether the item at the absolute index is only in the spill store; mu must be held
+func (rq *RollingQueue) isSpilled(index int) bool {
+	if rq.existsInBuffer(index) {
+		return false // or still loading into the buffer
+	}
+	return !rq.config.EnableOvercache || !rq.existsIndexInOverflow(index)
+}
+
+// Meta get the metadata recorded for the item at the absolute index
+func (rq *RollingQueue) Meta(index int) (TrackMeta, error) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if index < rq.minimumIndex || index >= rq.maximumIndex || index >= len(rq.meta) {
+		return TrackMeta{}, errors.New("IndexOutOfRange")
+	}
+	return rq.meta[index], nil
+}
+
+// Open get a reader of the encoded item at the absolute index, without moving anything which is reading it.
+// The reader is the caller's to close.
+func (rq *RollingQueue) Open(index int) (ReadSeekerCloser, error) {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if index < rq.minimumIndex || index >= rq.maximumIndex {
+		return nil, errors.New("IndexOutOfRange")
+	}
+	if index < len(rq.meta) && rq.meta[index].Path != "" {
+		return os.Open(rq.meta[index].Path)
+	}
+	if _, isOpen := rq.spillOpen[index]; rq.isSpilled(index) && !isOpen {
+		return rq.spill.Get(rq.spillKey(index))
+	}
+	file, err := rq.peek(index)
+	if err != nil {
+		return nil, err
+	}
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok || index >= len(rq.meta) {
+		return nil, errors.New("NotReadable")
+	}
+	// read at offsets, so the position of whatever is decoding it isn't moved
+	return NewWrapCloser(io.NewSectionReader(readerAt, 0, rq.meta[index].Size)), nil
+}
+
+// Append add file to the end of the queue, returning its absolute index
+func (rq *RollingQueue) Append(file ReadSeekerCloser) (int, error) {
+	meta, err := rq.readItemMeta(file)
+	if err != nil {
+		return -1, err
+	}
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.appendWithMeta(file, "", meta)
+}
+
+// appendWithMeta append file, which was opened from path (if not empty), returning its absolute index
+func (rq *RollingQueue) appendWithMeta(file ReadSeekerCloser, path string, meta TrackMeta) (index int, err error) {
+	index = -1
+	meta.Path = path
 	// A file may be stored (by priority):
 	// - in the memBuffer cache
 	// -	 in the overflow cache
 	// - on disk
+	err = rq.journalAppend(rq.maximumIndex, file, path)
+	if err != nil {
+		return
+	}
 	if rq.existsInBuffer(rq.maximumIndex) {
 		rq.memBuffer[rq.indexInBuffer(rq.maximumIndex)] = file
-		rq.maximumIndex++
 	} else {
 		// file must go in overflow cache or is persisted
-		overflowSuccess := rq.TryCacheInOverflow(rq.maximumIndex, file)
-		if overflowSuccess {
-			rq.maximumIndex++
-			return
-		}
-		// try to persist
-		err = rq.persist(rq.maximumIndex, file)
-		if err != nil {
-			return
+		overflowSuccess := rq.tryCacheInOverflow(rq.maximumIndex, file)
+		if !overflowSuccess {
+			// try to persist
+			err = rq.persist(rq.maximumIndex, file)
+			if err != nil {
+				return
+			}
 		}
-		rq.maximumIndex++
 	}
+	rq.meta = append(rq.meta, meta)
+	rq.maximumIndex++
+	index = rq.maximumIndex - 1
+	rq.orderAppended(index)
+	rq.journalSave()
+	info := meta.Info
+	rq.events.Publish(Event{Type: EventEnqueued, Index: index, Track: &info})
 	return
 }
 
-func (rq *RollingQueue) AppendCopy(file ReadSeekerCloser) (err error) {
-	var data []byte
-	data, err = ioutil.ReadAll(file)
-	if err != nil {
-		return
+// readTrackMeta inspect a file which is about to be queued; the error is why its audio format isn't known
+func readTrackMeta(file ReadSeekerCloser) (meta TrackMeta, err error) {
+	meta.Added = time.Now()
+	size, seekErr := file.Seek(0, io.SeekEnd)
+	if seekErr == nil {
+		meta.Size = size
 	}
-	newFilelike := NewWrapCloser(bytes.NewReader(data)) // manually implemented Close()
-	err = rq.Append(newFilelike)
+	meta.Type, err = probeAudioFormat(file)
+	meta.Info = readTrackInfo(file, meta.Type)
 	return
 }
 
-func (rq *RollingQueue) AppendFile(filename string) (err error) {
-	var diskFile *os.File
-	diskFile, err = os.Open(filename)
+// readItemMeta readTrackMeta, refusing items which aren't allowed audio when the queue only takes audio
+func (rq *RollingQueue) readItemMeta(file ReadSeekerCloser) (TrackMeta, error) {
+	meta, err := readTrackMeta(file)
+	if !rq.config.AudioOnly {
+		return meta, nil
+	}
+	if err == nil {
+		err = checkAllowedFormat(meta.Type)
+	}
+	return meta, err
+}
+
+// AppendCopy add a copy of file, stored wherever the queue spills items, to the end of the queue, returning its absolute index
+func (rq *RollingQueue) AppendCopy(file ReadSeekerCloser) (int, error) {
+	rq.mu.Lock()
+	rq.copies++
+	key := "copy" + strconv.Itoa(rq.copies) + rq.config.FilenameEnd
+	rq.mu.Unlock()
+	if err := rq.spill.Put(key, file); err != nil {
+		return -1, err
+	}
+	newFilelike, err := rq.spill.Get(key)
+	rq.spill.Delete(key) // an open file can still be read once it's removed
+	if err != nil {
+		return -1, err
+	}
+	index, err := rq.Append(newFilelike)
+	if err != nil {
+		newFilelike.Close()
+	}
+	return index, err
+}
+
+// AppendFile add a file on disk to the end of the queue, returning its absolute index
+func (rq *RollingQueue) AppendFile(filename string) (int, error) {
+	diskFile, err := openAbs(filename)
 	if err != nil {
-		return
+		return -1, err
 	}
-	err = rq.Append(diskFile)
-	return
+	meta, err := rq.readItemMeta(diskFile)
+	if err != nil {
+		diskFile.Close()
+		return -1, err
+	}
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.appendWithMeta(diskFile, diskFile.Name(), meta)
+}
+
+// openAbs open a file by its absolute path, so the path stays valid if the working directory changes
+func openAbs(filename string) (*os.File, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
 }
 
 // Close call Close on all containing files and cleanup persisted files
 func (rq *RollingQueue) Close() (err error) {
-	if !rq.waitForLoadComplete() {
-		go rq.loadComplete(false)
-		return errors.New("LoadFailure")
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	err = rq.waitForLoads()
+	if err != nil {
+		return
+	}
+	err = rq.journalSave()
+	if err != nil {
+		return
 	}
 	// memBuffer
 	minBufferIndex := 0
@@ -386,6 +678,9 @@ func (rq *RollingQueue) Close() (err error) {
 		maxBufferIndex = rq.indexInBuffer(rq.maximumIndex - 1)
 	}
 	for i := minBufferIndex; i <= maxBufferIndex; i++ {
+		if rq.memBuffer[i] == nil {
+			continue
+		}
 		err = rq.memBuffer[i].Close()
 		if err != nil {
 			return
@@ -405,16 +700,9 @@ func (rq *RollingQueue) Close() (err error) {
 			}
 		}
 	}
-	// persisted previous items
-	if rq.config.PersistToDisk {
-		for i := 0; i < rq.currentIndex-rq.config.MemBufferSize; i++ {
-			os.Remove(rq.generateFilename(i))
-		}
-	}
-	// persisted next items
-	for i := rq.currentIndex + rq.config.MemBufferSize + 1; i < rq.maximumIndex; i++ {
-		os.Remove(rq.generateFilename(i))
-	}
+	// spilled items
+	rq.closeSpilled()
+	err = rq.spill.Clear()
 	return
 }
 
@@ -440,11 +728,11 @@ func (b *WrapCloser) Read(p []byte) (n int, err error) {
 	return
 }
 
-func copyReader(reader io.Reader) (ReadSeekerCloser, error) {
-	data, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return nil, err
+// ReadAt read from the wrapped file without moving it, when it supports that
+func (b *WrapCloser) ReadAt(p []byte, off int64) (int, error) {
+	readerAt, ok := b.file.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("NotReaderAt")
 	}
-	res := NewWrapCloser(bytes.NewReader(data))
-	return res, nil
+	return readerAt.ReadAt(p, off)
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -127,6 +128,52 @@ func TestNoPersist(t *testing.T) {
 	}
 }
 
+func TestJournalRestore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomjournal")
+	defer os.RemoveAll(dir)
+	defer cleanupDummyFiles()
+	qc := nopersist_test_qc
+	qc.JournalDir = dir
+	q := NewRollingQueue(qc)
+	filenames := generateDummyFiles(4)
+	q.AppendFile(filenames[0])
+	for _, filename := range filenames[1:] {
+		f, _ := os.Open(filename)
+		q.AppendCopy(f) // copied into the journal
+		f.Close()
+	}
+	q.Next()
+	q.Next()
+	q.Close()
+
+	restored := NewRollingQueue(qc)
+	defer restored.Close()
+	if restored.JournalErr() != nil {
+		t.Fatalf("Journal restore raised error %s", restored.JournalErr())
+	}
+	if restored.MaximumIndex() != 4 || restored.Index() != 1 {
+		t.Fatalf("Expected 4 items at index 1, got %d items at index %d", restored.MaximumIndex(), restored.Index())
+	}
+	meta, err := restored.Meta(0)
+	if err != nil || meta.Size != int64(len(filenames[0])) {
+		t.Errorf("Expected restored metadata, got %+v (%v)", meta, err)
+	}
+	for i := 1; i < 4; i++ {
+		f, err := restored.Now()
+		if err != nil {
+			t.Fatalf("restored.Now() raised error %s", err)
+		}
+		f.Seek(0, 0)
+		data, _ := ioutil.ReadAll(f)
+		if string(data) != filenames[i] {
+			t.Errorf("Expected restored item %d to contain %s, got %s", i, filenames[i], string(data))
+		}
+		if restored.HasNext() {
+			restored.Next()
+		}
+	}
+}
+
 func generateDummyFiles(count int) []string {
 	res := []string{}
 	for i := 0; i < count; i++ {
@@ -151,3 +198,52 @@ func cleanupDummyFiles() {
 		}
 	}
 }
+
+// TestQueueConcurrent move through the queue while other goroutines append to & inspect it
+func TestQueueConcurrent(t *testing.T) {
+	q := NewRollingQueue(full_test_qc)
+	defer cleanupDummyFiles()
+	filenames := generateDummyFiles(40)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, filename := range filenames {
+			if _, err := q.AppendFile(filename); err != nil {
+				t.Errorf("q.AppendFile() raised error %s", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			index := q.Index()
+			q.Location(index)
+			q.Meta(index)
+			q.PeekNext()
+		}
+	}()
+	moves := 0
+	for moves < len(filenames) {
+		if !q.HasNext() {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		f, err := q.Next()
+		if err != nil {
+			t.Fatalf("q.Next() raised error %s (count = %d)", err, moves)
+		}
+		f.Seek(0, 0)
+		data, _ := ioutil.ReadAll(f)
+		if string(data) != filenames[moves] {
+			t.Fatalf("Expected %s, got %s", filenames[moves], data)
+		}
+		if moves%5 == 4 {
+			q.Previous()
+			q.Next()
+		}
+		moves++
+	}
+	wg.Wait()
+	q.Close()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	movingSuffix = ".moving" // persisted files are renamed to this while the queue is renumbered
+)
+
+// Remove take the item at the absolute index out of the queue; later items move down by one.
+// The current item can't be removed.
+func (rq *RollingQueue) Remove(index int) error {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	if index < rq.minimumIndex || index >= rq.maximumIndex {
+		return errors.New("IndexOutOfRange")
+	}
+	if index == rq.currentIndex {
+		return errors.New("CannotRemoveCurrent")
+	}
+	order := []int{}
+	for i := rq.minimumIndex; i < rq.maximumIndex; i++ {
+		if i != index {
+			order = append(order, i)
+		}
+	}
+	return rq.rearrange(order)
+}
+
+// Move move the item at the absolute index from to the absolute index to, shifting the items in between
+func (rq *RollingQueue) Move(from, to int) error {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.move(from, to)
+}
+
+func (rq *RollingQueue) move(from, to int) error {
+	if from < rq.minimumIndex || from >= rq.maximumIndex || to < rq.minimumIndex || to >= rq.maximumIndex {
+		return errors.New("IndexOutOfRange")
+	}
+	if from == to {
+		return nil
+	}
+	order := []int{}
+	for i := rq.minimumIndex; i < rq.maximumIndex; i++ {
+		if i != from {
+			order = append(order, i)
+		}
+	}
+	pos := to - rq.minimumIndex
+	order = append(order, 0)
+	copy(order[pos+1:], order[pos:])
+	order[pos] = from
+	return rq.rearrange(order)
+}
+
+// InsertAfterCurrent add a file to the queue so it is the next item played, returning its absolute index
+func (rq *RollingQueue) InsertAfterCurrent(file ReadSeekerCloser) (int, error) {
+	meta, err := rq.readItemMeta(file)
+	if err != nil {
+		return -1, err
+	}
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	index, err := rq.appendWithMeta(file, "", meta)
+	if err != nil {
+		return -1, err
+	}
+	return rq.moveAfterCurrent(index)
+}
+
+// InsertFileAfterCurrent add a file on disk to the queue so it is the next item played, returning its absolute index
+func (rq *RollingQueue) InsertFileAfterCurrent(filename string) (int, error) {
+	diskFile, err := openAbs(filename)
+	if err != nil {
+		return -1, err
+	}
+	meta, err := rq.readItemMeta(diskFile)
+	if err != nil {
+		diskFile.Close()
+		return -1, err
+	}
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	index, err := rq.appendWithMeta(diskFile, diskFile.Name(), meta)
+	if err != nil {
+		return -1, err
+	}
+	return rq.moveAfterCurrent(index)
+}
+
+func (rq *RollingQueue) moveAfterCurrent(index int) (int, error) {
+	target := rq.currentIndex + 1
+	if target < rq.minimumIndex {
+		target = rq.minimumIndex
+	}
+	err := rq.move(index, target)
+	if err != nil {
+		return index, err
+	}
+	if rq.isShuffled {
+		// play next in the shuffled order too
+		for i, orderIndex := range rq.order {
+			if orderIndex == target {
+				rq.order = append(rq.order[:i], rq.order[i+1:]...)
+				if i <= rq.orderPos {
+					rq.orderPos--
+				}
+				break
+			}
+		}
+		pos := rq.orderPos + 1
+		rq.order = append(rq.order, 0)
+		copy(rq.order[pos+1:], rq.order[pos:])
+		rq.order[pos] = target
+	}
+	return target, nil
+}
+
+// Clear remove every item except the current one
+func (rq *RollingQueue) Clear() error {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	order := []int{}
+	if rq.currentIndex != -1 && rq.currentIndex >= rq.minimumIndex {
+		order = append(order, rq.currentIndex)
+	}
+	return rq.rearrange(order)
+}
+
+// rearrange renumber the queue so it holds the items at the absolute indexes in order, from the
+// minimum index up, wherever each item is stored. Items missing from order are closed & deleted.
+func (rq *RollingQueue) rearrange(order []int) error {
+	if err := rq.waitForLoads(); err != nil {
+		return err
+	}
+	// spilled items are renumbered, so they're opened again afterwards; the player drops its next track before editing
+	rq.closeSpilled()
+	// take every item out of memory & the overflow cache; the rest are persisted on disk
+	files := map[int]ReadSeekerCloser{}
+	for i, file := range rq.memBuffer {
+		if file != nil {
+			files[rq.currentIndex-rq.config.MemBufferSize+i] = file
+		}
+		rq.memBuffer[i] = nil
+	}
+	for i, index := range rq.overflowIndexes {
+		if index != -1 {
+			files[index] = rq.overflowBuffer[i]
+			rq.overflowBuffer[i] = nil
+			rq.overflowIndexes[i] = -1
+		}
+	}
+	// move spilled items aside, so renumbering them can't overwrite one another
+	moving := map[int]string{}
+	for index := rq.minimumIndex; index < rq.maximumIndex; index++ {
+		if files[index] != nil {
+			continue
+		}
+		key := rq.spillKey(index)
+		if rq.spill.Rename(key, key+movingSuffix) == nil {
+			moving[index] = key + movingSuffix
+		}
+	}
+	newIndexes := map[int]int{}
+	for pos, index := range order {
+		newIndexes[index] = rq.minimumIndex + pos
+	}
+	for index, file := range files {
+		if _, ok := newIndexes[index]; !ok {
+			file.Close()
+		}
+	}
+	for index, key := range moving {
+		if _, ok := newIndexes[index]; !ok {
+			rq.spill.Delete(key)
+		}
+	}
+	if newCurrent, ok := newIndexes[rq.currentIndex]; ok {
+		rq.currentIndex = newCurrent
+	} else if rq.currentIndex >= rq.minimumIndex {
+		rq.currentIndex = rq.minimumIndex - 1 // nothing is current any more
+	}
+	var err error
+	for _, oldIndex := range order {
+		index := newIndexes[oldIndex]
+		file := files[oldIndex]
+		var placeErr error
+		if file == nil {
+			key, ok := moving[oldIndex]
+			if !ok {
+				placeErr = errors.New("MissingPersistedItem")
+			} else if rq.existsInBuffer(index) {
+				rq.memBuffer[rq.indexInBuffer(index)], placeErr = rq.spill.Get(key)
+				if placeErr == nil {
+					rq.spill.Delete(key)
+				}
+			} else {
+				placeErr = rq.spill.Rename(key, rq.spillKey(index))
+			}
+		} else if rq.existsInBuffer(index) {
+			rq.memBuffer[rq.indexInBuffer(index)] = file
+		} else if !rq.tryCacheInOverflow(index, file) {
+			placeErr = rq.persist(index, file)
+		}
+		if placeErr != nil && err == nil {
+			err = placeErr
+		}
+	}
+	meta := append([]TrackMeta{}, rq.meta[:rq.minimumIndex]...)
+	for _, oldIndex := range order {
+		meta = append(meta, rq.meta[oldIndex])
+	}
+	rq.meta = meta
+	rq.maximumIndex = rq.minimumIndex + len(order)
+	rq.orderRenumbered(newIndexes)
+	rq.journalRenumber(newIndexes)
+	rq.journalSave()
+	return err
+}
+
+// orderRenumbered update the shuffled play order after the queue is rearranged
+func (rq *RollingQueue) orderRenumbered(newIndexes map[int]int) {
+	rq.nextOrder = nil
+	if !rq.isShuffled {
+		return
+	}
+	order := []int{}
+	pos := -1
+	for i, index := range rq.order {
+		newIndex, ok := newIndexes[index]
+		if !ok {
+			continue
+		}
+		if i <= rq.orderPos {
+			pos = len(order)
+		}
+		order = append(order, newIndex)
+	}
+	rq.order = order
+	rq.orderPos = pos
+}
+
+// journalRenumber update the journal after the queue is rearranged, renaming blobs to match
+func (rq *RollingQueue) journalRenumber(newIndexes map[int]int) {
+	if !rq.isJournaled() {
+		return
+	}
+	tracks := []journalTrack{}
+	for _, entry := range rq.journalTracks {
+		newIndex, ok := newIndexes[entry.Index]
+		if !ok {
+			if entry.Blob != "" {
+				os.Remove(filepath.Join(rq.config.JournalDir, entry.Blob))
+			}
+			continue
+		}
+		if entry.Blob != "" && newIndex != entry.Index {
+			blob := filepath.Join(rq.config.JournalDir, entry.Blob)
+			os.Rename(blob, blob+movingSuffix)
+			entry.Blob += movingSuffix
+		}
+		entry.Index = newIndex
+		tracks = append(tracks, entry)
+	}
+	for i := range tracks {
+		if filepath.Ext(tracks[i].Blob) == movingSuffix {
+			blob := rq.journalBlobName(tracks[i].Index)
+			os.Rename(filepath.Join(rq.config.JournalDir, tracks[i].Blob), filepath.Join(rq.config.JournalDir, blob))
+			tracks[i].Blob = blob
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Index < tracks[j].Index })
+	rq.journalTracks = tracks
+}
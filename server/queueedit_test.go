@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// queueContents read every item from the start of the queue to the end, then return to the current item
+func queueContents(t *testing.T, q *RollingQueue) []string {
+	readItem := itemReader(t)
+	start := q.Index()
+	for q.HasPrevious() {
+		q.Previous()
+	}
+	contents := []string{readItem(q.Now())}
+	for q.HasNext() {
+		contents = append(contents, readItem(q.Next()))
+	}
+	for q.Index() > start {
+		q.Previous()
+	}
+	return contents
+}
+
+// newEditTestQueue queue count dummy files and move onto the item at current
+func newEditTestQueue(qc QueueConfig, count, current int) (*RollingQueue, []string) {
+	q := NewRollingQueue(qc)
+	filenames := generateDummyFiles(count)
+	for _, filename := range filenames {
+		q.AppendFile(filename)
+	}
+	for q.Index() < current {
+		q.Next()
+	}
+	return q, filenames
+}
+
+func expectNoPersistedFiles(t *testing.T) {
+	for _, pattern := range []string{FilenameStart + "*" + FilenameEnd, "*" + movingSuffix} {
+		if matches, _ := filepath.Glob(pattern); len(matches) != 0 {
+			t.Errorf("Leftover persisted files %v", matches)
+		}
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q, _ := newEditTestQueue(full_test_qc, 10, 4)
+	defer cleanupDummyFiles()
+	filenames := generateDummyFiles(12)
+	q.AppendFile(filenames[10])
+	q.AppendFile(filenames[11])
+	// 0 & 1 are persisted, 2 to 6 are in memory, 7 to 9 are persisted & 10 & 11 are in the overflow cache
+	for index, expected := range map[int]string{0: "disk", 5: "memory", 8: "disk", 11: "overflow"} {
+		if location, _ := q.Location(index); location != expected {
+			t.Errorf("Expected item %d in %s, it is in %s", index, expected, location)
+		}
+	}
+	expected := append([]string{}, filenames...)
+	for _, index := range []int{11, 8, 5, 0} {
+		if err := q.Remove(index); err != nil {
+			t.Fatalf("q.Remove(%d) raised error %s", index, err)
+		}
+		expected = append(expected[:index], expected[index+1:]...)
+	}
+	if q.Index() != 3 || q.MaximumIndex() != 8 {
+		t.Errorf("Expected current index 3 of 8, got %d of %d", q.Index(), q.MaximumIndex())
+	}
+	if contents := queueContents(t, q); !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected queue %v, got %v", expected, contents)
+	}
+	if meta, _ := q.Meta(3); meta.Size != int64(len(filenames[4])) {
+		t.Errorf("Metadata did not move with its item")
+	}
+	if err := q.Remove(q.Index()); err == nil {
+		t.Errorf("Expected error removing the current item")
+	}
+	if err := q.Remove(q.MaximumIndex()); err == nil {
+		t.Errorf("Expected error removing a non-existent item")
+	}
+	q.Close()
+	expectNoPersistedFiles(t)
+}
+
+func TestQueueMove(t *testing.T) {
+	q, filenames := newEditTestQueue(full_test_qc, 12, 4)
+	defer cleanupDummyFiles()
+	expected := append([]string{}, filenames...)
+	move := func(from, to int) {
+		if err := q.Move(from, to); err != nil {
+			t.Fatalf("q.Move(%d, %d) raised error %s", from, to, err)
+		}
+		item := expected[from]
+		expected = append(expected[:from], expected[from+1:]...)
+		expected = append(expected[:to], append([]string{item}, expected[to:]...)...)
+	}
+	move(11, 5) // disk to memory
+	move(1, 10) // disk to disk, moving the current item down
+	move(3, 0)  // the current item itself
+	if q.Index() != 0 {
+		t.Errorf("Expected current item to move to 0, it is at %d", q.Index())
+	}
+	if contents := queueContents(t, q); !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected queue %v, got %v", expected, contents)
+	}
+	q.Close()
+	expectNoPersistedFiles(t)
+}
+
+func TestQueueInsertAfterCurrent(t *testing.T) {
+	q, filenames := newEditTestQueue(nopersist_test_qc, 8, 1)
+	readItem := itemReader(t)
+	defer cleanupDummyFiles()
+	defer q.Close()
+	extra := generateDummyFiles(10)[8:]
+	index, err := q.InsertFileAfterCurrent(extra[0])
+	if err != nil || index != 2 {
+		t.Fatalf("q.InsertFileAfterCurrent() returned %d, %v", index, err)
+	}
+	if item := readItem(q.Next()); item != extra[0] {
+		t.Errorf("Expected inserted item next, got %s", item)
+	}
+	if item := readItem(q.Next()); item != filenames[2] {
+		t.Errorf("Expected queue to continue after inserted item, got %s", item)
+	}
+	q.SetShuffle(true)
+	f, _ := os.Open(extra[1])
+	index, _ = q.InsertAfterCurrent(f)
+	if item := readItem(q.Next()); item != extra[1] || q.Index() != index {
+		t.Errorf("Expected inserted item next while shuffled, got %s", item)
+	}
+}
+
+func TestQueueClear(t *testing.T) {
+	q, filenames := newEditTestQueue(full_test_qc, 12, 4)
+	defer cleanupDummyFiles()
+	if err := q.Clear(); err != nil {
+		t.Fatalf("q.Clear() raised error %s", err)
+	}
+	if q.HasNext() || q.HasPrevious() || q.MaximumIndex() != 1 {
+		t.Errorf("Expected only the current item to be left, maximum index is %d", q.MaximumIndex())
+	}
+	if contents := queueContents(t, q); !reflect.DeepEqual(contents, filenames[4:5]) {
+		t.Errorf("Expected queue %v, got %v", filenames[4:5], contents)
+	}
+	q.Close()
+	expectNoPersistedFiles(t)
+}
+
+func TestQueueEditJournal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomjournal")
+	defer os.RemoveAll(dir)
+	defer cleanupDummyFiles()
+	qc := nopersist_test_qc
+	qc.JournalDir = dir
+	q := NewRollingQueue(qc)
+	filenames := generateDummyFiles(4)
+	for _, filename := range filenames {
+		f, _ := os.Open(filename)
+		q.AppendCopy(f) // copied into the journal
+		f.Close()
+	}
+	q.Next()
+	q.Move(3, 1)
+	q.Remove(2)
+	restored := NewRollingQueue(qc)
+	if err := restored.JournalErr(); err != nil {
+		t.Fatalf("Restoring journal raised error %s", err)
+	}
+	expected := []string{filenames[0], filenames[3], filenames[2]}
+	if contents := queueContents(t, restored); !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected restored queue %v, got %v", expected, contents)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(dir, JournalBlobStart+"*")); len(blobs) != 3 {
+		t.Errorf("Expected 3 journal blobs, found %v", blobs)
+	}
+}
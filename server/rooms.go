@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/faiface/beep"
+)
+
+const (
+	RoomsPrefix     = "/rooms"
+	RoomsFilename   = "rooms.json"
+	RoomsDirname    = "rooms"
+	DefaultRoomName = "default" // the player started with the server, also served at /
+	maxRoomName     = 32
+	maxRoomBody     = 64 * 1024
+)
+
+type roomContextKey struct{}
+
+// RoomConfig how a room outputs audio; saved so rooms come back after a restart
+type RoomConfig struct {
+	Output  string `json:"output"`            // speaker, null or wav
+	WavFile string `json:"wavfile,omitempty"` // recording made by the wav output, inside the root directory
+	Stream  bool   `json:"stream"`            // also stream the room's output at /rooms/{name}/stream
+}
+
+// Room a player with its own queue & output, served under /rooms/{name}/
+type Room struct {
+	Name   string
+	Config RoomConfig
+	Player *Player
+	Stream *StreamSink // nil when the room isn't streamed
+}
+
+type roomSummary struct {
+	Name   string       `json:"name"`
+	Config RoomConfig   `json:"config"`
+	Status PlayerStatus `json:"status"`
+}
+
+type roomsBody struct {
+	Rooms []roomSummary `json:"rooms"`
+}
+
+// RoomManager rooms hosted alongside the default one
+type RoomManager struct {
+	mu       sync.RWMutex
+	filename string
+	rooms    map[string]*Room
+}
+
+// NewRoomManager create the rooms saved in filename, if there are any
+func NewRoomManager(filename string) (*RoomManager, error) {
+	m := &RoomManager{filename: filename, rooms: map[string]*Room{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var configs map[string]RoomConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err = m.create(name, configs[name]); err != nil {
+			fmt.Printf("Unable to restore room %s: %s\n", name, err)
+		}
+	}
+	return m, nil
+}
+
+// validRoomName whether name can be used as a room name, and so in URLs & filenames
+func validRoomName(name string) bool {
+	if name == "" || len(name) > maxRoomName {
+		return false
+	}
+	for _, c := range name {
+		isAllowed := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+		if !isAllowed {
+			return false
+		}
+	}
+	return true
+}
+
+// roomQueueConfig queue settings for a room, keeping its spilled items & journal apart from other rooms'
+func roomQueueConfig(name string) QueueConfig {
+	qc := queueConfig()
+	qc.FilenameStart = FilenameStart + "-" + name + "-"
+	qc.SpillDir = filepath.Join(qc.SpillDir, RoomsDirname, name)
+	if qc.JournalDir != "" {
+		qc.JournalDir = filepath.Join(RootPath, RoomsDirname, name, JournalDirname)
+	}
+	return qc
+}
+
+// defaultRoom the player started with the server, as a room
+func defaultRoom() *Room {
+	config := RoomConfig{Output: Output, Stream: Stream}
+	if config.Output == "" {
+		config.Output = OutputSpeaker
+	}
+	if config.Output == OutputWav {
+		config.WavFile = WavPath
+	}
+	return &Room{Name: DefaultRoomName, Config: config, Player: PlayerInst, Stream: StreamOutput}
+}
+
+// speakerInUse whether a room already plays through the speaker, which there is only one of
+func (m *RoomManager) speakerInUse() bool {
+	if PlayerInst != nil && defaultRoom().Config.Output == OutputSpeaker {
+		return true
+	}
+	for _, room := range m.rooms {
+		if room.Config.Output == OutputSpeaker {
+			return true
+		}
+	}
+	return false
+}
+
+// create set up a room's output & player; the caller must hold the lock, or be the constructor
+func (m *RoomManager) create(name string, config RoomConfig) (*Room, error) {
+	if !validRoomName(name) {
+		return nil, errors.New("InvalidRoomName")
+	}
+	if _, exists := m.rooms[name]; exists || name == DefaultRoomName {
+		return nil, errors.New("RoomExists")
+	}
+	if config.Output == "" {
+		config.Output = OutputSpeaker
+	}
+	var sink AudioSink
+	var err error
+	switch config.Output {
+	case OutputSpeaker:
+		if m.speakerInUse() {
+			return nil, errors.New("SpeakerInUse")
+		}
+		sink = &SpeakerSink{}
+	case OutputWav:
+		if config.WavFile == "" {
+			config.WavFile = name + ".wav"
+		}
+		wavPath, pathErr := resolveRootPath(config.WavFile)
+		if pathErr != nil {
+			return nil, pathErr
+		}
+		sink = NewWavSink(wavPath)
+	default:
+		config.WavFile = ""
+		sink, err = NewAudioSink(config.Output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	room := &Room{Name: name, Config: config}
+	if config.Stream {
+		room.Stream = NewStreamSink(sink, beep.SampleRate(SampleRate))
+		sink = room.Stream
+	}
+	room.Player = NewPlayer(sink)
+	room.Player.QueueConfig = roomQueueConfig(name)
+	room.Player.Init()
+	m.rooms[name] = room
+	return room, nil
+}
+
+// save write every room's config to disk
+func (m *RoomManager) save() error {
+	configs := map[string]RoomConfig{}
+	for name, room := range m.rooms {
+		configs[name] = room.Config
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.filename, data)
+}
+
+// Create add a room, which is remembered across restarts
+func (m *RoomManager) Create(name string, config RoomConfig) (*Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.create(name, config)
+	if err != nil {
+		return nil, err
+	}
+	err = m.save()
+	if err != nil {
+		delete(m.rooms, name)
+		room.Player.Close()
+		return nil, err
+	}
+	return room, nil
+}
+
+// Delete stop a room's player and forget it, including its journal
+func (m *RoomManager) Delete(name string) error {
+	m.mu.Lock()
+	room, ok := m.rooms[name]
+	if !ok {
+		m.mu.Unlock()
+		return errors.New("NoSuchRoom")
+	}
+	delete(m.rooms, name)
+	err := m.save()
+	m.mu.Unlock()
+	room.Player.Close()
+	os.RemoveAll(filepath.Join(RootPath, RoomsDirname, name))
+	return err
+}
+
+// Get find a room by name, including the default room
+func (m *RoomManager) Get(name string) (*Room, bool) {
+	if name == DefaultRoomName {
+		return defaultRoom(), PlayerInst != nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[name]
+	return room, ok
+}
+
+// List every room, the default room first then by name
+func (m *RoomManager) List() []*Room {
+	rooms := []*Room{}
+	if PlayerInst != nil {
+		rooms = append(rooms, defaultRoom())
+	}
+	m.mu.RLock()
+	names := []string{}
+	for name := range m.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rooms = append(rooms, m.rooms[name])
+	}
+	m.mu.RUnlock()
+	return rooms
+}
+
+// Close stop every room's player, leaving their journals for the next start
+func (m *RoomManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, room := range m.rooms {
+		if err := room.Player.Close(); err != nil {
+			fmt.Printf("Room %s shutdown problem: %s\n", name, err)
+		}
+	}
+}
+
+// allPlayers the default player and every room's
+func allPlayers() []*Player {
+	players := []*Player{}
+	if PlayerInst != nil {
+		players = append(players, PlayerInst)
+	}
+	if Rooms != nil {
+		Rooms.mu.RLock()
+		for _, room := range Rooms.rooms {
+			players = append(players, room.Player)
+		}
+		Rooms.mu.RUnlock()
+	}
+	return players
+}
+
+// playerOf the player a request is for: its room's, or the default one
+func playerOf(r *http.Request) *Player {
+	if room, ok := r.Context().Value(roomContextKey{}).(*Room); ok {
+		return room.Player
+	}
+	return PlayerInst
+}
+
+// streamOf the stream of the room a request is for; nil when it isn't streamed
+func streamOf(r *http.Request) *StreamSink {
+	if room, ok := r.Context().Value(roomContextKey{}).(*Room); ok {
+		return room.Stream
+	}
+	return StreamOutput
+}
+
+func (room *Room) summary() roomSummary {
+	return roomSummary{Name: room.Name, Config: room.Config, Status: room.Player.Status()}
+}
+
+// roomsHandler manage rooms at /rooms & /rooms/{name}, and serve /rooms/{name}/... from roomMux for that room
+func roomsHandler(roomMux *http.ServeMux) http.HandlerFunc {
+	manage := requireRoles(RoleListener, RoleAdmin, roomsManageHandler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, RoomsPrefix), "/")
+		subPath := ""
+		if slash := strings.Index(name, "/"); slash != -1 {
+			name, subPath = name[:slash], name[slash:]
+		}
+		if subPath == "" || subPath == "/" {
+			manage(w, r)
+			return
+		}
+		if Rooms == nil {
+			handleChores(w, r)
+			writeError(w, 404, "Rooms are unavailable")
+			return
+		}
+		room, ok := Rooms.Get(name)
+		if !ok {
+			handleChores(w, r)
+			writeError(w, 404, fmt.Sprintf("No room named %q", name))
+			return
+		}
+		roomRequest := r.WithContext(context.WithValue(r.Context(), roomContextKey{}, room))
+		roomURL := *r.URL
+		roomURL.Path, roomURL.RawPath = subPath, ""
+		roomRequest.URL = &roomURL
+		roomMux.ServeHTTP(w, roomRequest)
+	}
+}
+
+func roomsManageHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if Rooms == nil {
+		writeError(w, 404, "Rooms are unavailable")
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, RoomsPrefix), "/")
+	if name == "" {
+		if !allowMethods(w, r, "GET") {
+			return
+		}
+		body := roomsBody{Rooms: []roomSummary{}}
+		for _, room := range Rooms.List() {
+			body.Rooms = append(body.Rooms, room.summary())
+		}
+		writeJSON(w, 200, body)
+		return
+	}
+	if !allowMethods(w, r, "GET", "PUT", "DELETE") {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		room, ok := Rooms.Get(name)
+		if !ok {
+			writeError(w, 404, fmt.Sprintf("No room named %q", name))
+			return
+		}
+		writeJSON(w, 200, room.summary())
+	case "PUT":
+		var config RoomConfig
+		decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoomBody)).Decode(&config)
+		if decodeErr != nil {
+			writeError(w, 400, "Invalid JSON body: "+decodeErr.Error())
+			return
+		}
+		room, err := Rooms.Create(name, config)
+		if err != nil {
+			writeRoomError(w, name, err)
+			return
+		}
+		fmt.Printf("Created room %s with %s output\n", name, room.Config.Output)
+		writeJSON(w, 201, room.summary())
+	case "DELETE":
+		if name == DefaultRoomName {
+			writeError(w, 400, "The default room can't be deleted")
+			return
+		}
+		err := Rooms.Delete(name)
+		if err != nil {
+			writeRoomError(w, name, err)
+			return
+		}
+		fmt.Printf("Deleted room %s\n", name)
+		w.WriteHeader(204)
+	}
+}
+
+// writeRoomError respond with the status matching a RoomManager error
+func writeRoomError(w http.ResponseWriter, name string, err error) {
+	switch err.Error() {
+	case "NoSuchRoom":
+		writeError(w, 404, fmt.Sprintf("No room named %q", name))
+	case "InvalidRoomName":
+		writeError(w, 400, fmt.Sprintf("Invalid room name %q; use up to %d letters, digits, - or _", name, maxRoomName))
+	case "RoomExists":
+		writeError(w, 409, fmt.Sprintf("Room %q already exists", name))
+	case "SpeakerInUse":
+		writeError(w, 409, "Another room is already playing through the speaker")
+	case "UnknownOutput", "EmptyPath", "PathOutsideRoot":
+		writeError(w, 400, fmt.Sprintf("Invalid output for room %q: %s", name, err))
+	default:
+		writeError(w, 500, fmt.Sprintf("Failed to change room %q: %s", name, err))
+	}
+}
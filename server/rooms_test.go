@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func doRoomRequest(mux *http.ServeMux, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRooms(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomrooms")
+	defer os.RemoveAll(dir)
+	defer func(root string, sampleRate int64, quality int, buffer time.Duration, maxMemory int64) {
+		RootPath, SampleRate, Quality, Buffer, MaxMemory, Rooms = root, sampleRate, quality, buffer, maxMemory, nil
+	}(RootPath, SampleRate, Quality, Buffer, MaxMemory)
+	RootPath, SampleRate, Quality, Buffer, MaxMemory = dir, int64(testTrackFormat.SampleRate), 1, time.Second/100, DefaultMaxMemory
+	PlayerInst = newTestPlayer() // the default room, which has the speaker
+	var err error
+	Rooms, err = NewRoomManager(filepath.Join(dir, RoomsFilename))
+	if err != nil {
+		t.Fatalf("NewRoomManager() raised error %s", err)
+	}
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+
+	if rec := doRoomRequest(mux, "PUT", RoomsPrefix+"/kitchen", `{"output": "null", "stream": true}`); rec.Code != 201 {
+		t.Fatalf("Unexpected create response %d %s", rec.Code, rec.Body)
+	}
+	for _, c := range []struct {
+		name, body string
+		expected   int
+	}{
+		{"kitchen", `{"output": "null"}`, 409},
+		{"default", `{"output": "null"}`, 409},
+		{"lab%20two", `{"output": "null"}`, 400},
+		{"lab", `{"output": "midi"}`, 400},
+		{"lab", `{"output": "wav", "wavfile": "../lab.wav"}`, 400},
+		{"lab", `{"output": "speaker"}`, 409}, // the default room has it
+	} {
+		if rec := doRoomRequest(mux, "PUT", RoomsPrefix+"/"+c.name, c.body); rec.Code != c.expected {
+			t.Errorf("Expected status %d creating %s with %s, got %d %s", c.expected, c.name, c.body, rec.Code, rec.Body)
+		}
+	}
+
+	// each room has its own queue
+	track, _ := ioutil.ReadAll(generateTestTrack(time.Second))
+	submission := `{"files": [{"name": "a", "data": "` + base64.StdEncoding.EncodeToString(track) + `"}]}`
+	if rec := doRoomRequest(mux, "POST", RoomsPrefix+"/kitchen/music", submission); rec.Code != 200 {
+		t.Fatalf("Unexpected room music response %d %s", rec.Code, rec.Body)
+	}
+	rec := doRoomRequest(mux, "POST", RoomsPrefix+"/kitchen"+APIPrefix+"play", "")
+	var status PlayerStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != 200 || !status.Playing || status.MaximumIndex != 1 {
+		t.Errorf("Expected the kitchen to play its track, got %d %s", rec.Code, rec.Body)
+	}
+	if status = PlayerInst.Status(); status.MaximumIndex != 0 || status.Playing {
+		t.Errorf("Expected the default room to be untouched, got %+v", status)
+	}
+	if rec = doRoomRequest(mux, "GET", RoomsPrefix+"/default"+APIPrefix+"status", ""); rec.Code != 200 {
+		t.Errorf("Expected the default room at %s/default, got %d", RoomsPrefix, rec.Code)
+	}
+
+	rec = doRoomRequest(mux, "GET", RoomsPrefix, "")
+	var list roomsBody
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != 200 || len(list.Rooms) != 2 || list.Rooms[0].Name != DefaultRoomName || list.Rooms[1].Config.Output != OutputNull {
+		t.Errorf("Unexpected rooms response %d %s", rec.Code, rec.Body)
+	}
+
+	// rooms are remembered
+	restored, err := NewRoomManager(filepath.Join(dir, RoomsFilename))
+	if err != nil {
+		t.Fatalf("NewRoomManager() raised error %s restoring", err)
+	}
+	if room, ok := restored.Get("kitchen"); !ok || !room.Config.Stream || room.Stream == nil {
+		t.Errorf("Expected the kitchen to be restored with a stream, got %+v", room)
+	}
+	restored.Close()
+
+	if rec = doRoomRequest(mux, "DELETE", RoomsPrefix+"/kitchen", ""); rec.Code != 204 {
+		t.Errorf("Expected status 204 deleting a room, got %d", rec.Code)
+	}
+	for method, path := range map[string]string{
+		"GET":    RoomsPrefix + "/kitchen" + APIPrefix + "status",
+		"DELETE": RoomsPrefix + "/kitchen",
+	} {
+		if rec = doRoomRequest(mux, method, path, ""); rec.Code != 404 {
+			t.Errorf("Expected status 404 for %s %s after deleting, got %d", method, path, rec.Code)
+		}
+	}
+	if rec = doRoomRequest(mux, "DELETE", RoomsPrefix+"/default", ""); rec.Code != 400 {
+		t.Errorf("Expected status 400 deleting the default room, got %d", rec.Code)
+	}
+}
@@ -3,11 +3,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/faiface/beep"
 )
 
 const (
@@ -15,61 +22,235 @@ const (
 )
 
 var (
-	Maintainers = []string{"NGnius"}
-	StartTime   = time.Now()
-	PlayerInst  *Player
-	HandlerMux  *http.ServeMux
-	Server      *http.Server
+	Maintainers  = []string{"NGnius"}
+	StartTime    = time.Now()
+	PlayerInst   *Player
+	HandlerMux   *http.ServeMux
+	Server       *http.Server
+	Auth         *Authenticator // nil when authentication is disabled
+	StreamOutput *StreamSink    // nil when streaming is disabled
+	LibraryInst  *Library       // nil when the library is disabled
+	Playlists    *PlaylistStore // nil when playlists can't be saved
+	Rooms        *RoomManager   // nil when rooms can't be restored
+	Follower     *SyncFollower  // nil unless following a leader server
+	Uploads      *UploadStore   // nil when uploads are kept in memory
+	shutdownDone chan bool      // closed when Exit has finished
+	stopRequests context.CancelFunc
+	exiting      int32 // 1 once Exit has begun
 )
 
 func Initialize() {
-	// handle interrupt (terminate) signal
+	// handle interrupt (terminate) signal; a second one exits without waiting
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		s := <-signalChan
 		fmt.Println("Received terminate signal " + s.String())
-		Exit()
+		go Exit()
+		<-signalChan
+		fmt.Println("Received second terminate signal, exiting now")
+		os.Exit(1)
 	}()
 	// parse command line arguments
 	initCommandLineArgs()
-	processCommandLineArgs()
+	if configErr := processCommandLineArgs(); configErr != nil {
+		fmt.Println(configErr.Error())
+		os.Exit(1)
+	}
 	if Version {
 		printDebugVersionInfo()
 		os.Exit(0)
 	}
 	fmt.Printf("Version: %s\n", VersionString())
+	setDebugLogging(Debug)
+	formats, formatsErr := parseAllowedFormats(Formats)
+	if formatsErr != nil {
+		fmt.Println("Invalid formats " + Formats + ": " + formatsErr.Error())
+		os.Exit(1)
+	}
+	setAllowedFormats(formats)
+	allowedOrigins = parseOrigins(Origins)
+	if QueueStore != QueueStoreDisk && QueueStore != QueueStoreMemory {
+		fmt.Println("Invalid queue store " + QueueStore + ": must be " + QueueStoreDisk + " or " + QueueStoreMemory)
+		os.Exit(1)
+	}
 	// init server
-	PlayerInst = NewPlayer()
+	sink, sinkErr := NewAudioSink(Output)
+	if sinkErr != nil {
+		fmt.Println("Invalid output " + Output + ": " + sinkErr.Error())
+		os.Exit(1)
+	}
+	if Stream {
+		StreamOutput = NewStreamSink(sink, beep.SampleRate(SampleRate))
+		sink = StreamOutput
+	}
+	if QueueStore == QueueStoreDisk {
+		clearStaleSpills(queueConfig().SpillDir)
+	}
+	PlayerInst = NewPlayer(sink)
 	PlayerInst.Init()
 	fmt.Println("Server initialising")
-	HandlerMux = http.NewServeMux()
-	HandlerMux.HandleFunc("/", htmlHandler)
-	HandlerMux.HandleFunc("/music", musicHandler)
-	HandlerMux.HandleFunc("/play", playHandler)
-	HandlerMux.HandleFunc("/pause", pauseHandler)
-	HandlerMux.HandleFunc("/next", nextHandler)
-	HandlerMux.HandleFunc("/previous", previousHandler)
-	if Debug {
-		HandlerMux.HandleFunc("/exit", exitHandler)
-		HandlerMux.HandleFunc("/debug", debugHandler)
-	}
-	Server = &http.Server{
-		Addr:    ":" + Port,
-		Handler: HandlerMux,
+	if Follow != "" {
+		follower, followErr := NewSyncFollower(Follow, PlayerInst, SyncTolerance)
+		if followErr != nil {
+			fmt.Println("Invalid leader " + Follow + ": " + followErr.Error())
+			os.Exit(1)
+		}
+		Follower = follower
+		Follower.Start()
 	}
+	if AuthPath != "" {
+		authConfig, authErr := LoadAuthConfig(AuthPath)
+		if authErr != nil {
+			fmt.Println("Invalid auth config " + AuthPath + ": " + authErr.Error())
+			os.Exit(1)
+		}
+		Auth = NewAuthenticator(authConfig)
+		fmt.Printf("Loaded %d users and %d tokens\n", len(authConfig.Users), len(authConfig.Tokens))
+	} else if InlineAuth != nil {
+		Auth = NewAuthenticator(*InlineAuth)
+		fmt.Printf("Loaded %d users and %d tokens from config\n", len(InlineAuth.Users), len(InlineAuth.Tokens))
+	}
+	if LibraryDirs != "" {
+		LibraryInst = NewLibrary(parseLibraryDirs(LibraryDirs))
+		go LibraryInst.Scan()
+	}
+	playlists, playlistsErr := NewPlaylistStore(filepath.Join(RootPath, PlaylistsDirname))
+	if playlistsErr != nil {
+		fmt.Println("Playlists unavailable: " + playlistsErr.Error())
+	} else {
+		Playlists = playlists
+	}
+	rooms, roomsErr := NewRoomManager(filepath.Join(RootPath, RoomsFilename))
+	if roomsErr != nil {
+		fmt.Println("Rooms unavailable: " + roomsErr.Error())
+	} else {
+		Rooms = rooms
+	}
+	uploads, uploadsErr := NewUploadStore(filepath.Join(RootPath, UploadsDirname))
+	if uploadsErr != nil {
+		fmt.Println("Uploads will be kept in memory: " + uploadsErr.Error())
+	} else {
+		Uploads = uploads
+		go func() {
+			// the queues & playlists which use them are loaded by now
+			for {
+				pruneUploads()
+				time.Sleep(UploadsGrace)
+			}
+		}()
+	}
+	HandlerMux = http.NewServeMux()
+	registerHandlers(HandlerMux)
+	Server = newServer(":"+Port, HandlerMux)
+	// re-read the configuration on hangup signal
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			fmt.Println("Received reload signal")
+			ReloadConfiguration()
+		}
+	}()
 	fmt.Println("Server initialised in " + time.Since(StartTime).String())
 }
 
+// registerHandlers add every endpoint to mux, with the role each one needs
+func registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", requireRole(RoleListener, htmlHandler))
+	registerPlayerHandlers(mux)
+	roomMux := http.NewServeMux()
+	registerPlayerHandlers(roomMux)
+	mux.HandleFunc(RoomsPrefix, roomsHandler(roomMux))
+	mux.HandleFunc(RoomsPrefix+"/", roomsHandler(roomMux))
+	mux.HandleFunc("/exit", requireDebug(requireRole(RoleAdmin, exitHandler)))
+	mux.HandleFunc("/debug", requireDebug(requireRole(RoleAdmin, debugHandler)))
+}
+
+// registerPlayerHandlers add the endpoints which use a player; served for the default room at /, and for each room at /rooms/{name}/
+func registerPlayerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/music", requireRole(RoleDJ, musicHandler))
+	mux.HandleFunc("/play", requireRole(RoleDJ, playHandler))
+	mux.HandleFunc("/pause", requireRole(RoleDJ, pauseHandler))
+	mux.HandleFunc("/next", requireRole(RoleDJ, nextHandler))
+	mux.HandleFunc("/previous", requireRole(RoleDJ, previousHandler))
+	mux.HandleFunc("/seek", requireRole(RoleDJ, seekHandler))
+	mux.HandleFunc("/position", requireRole(RoleListener, positionHandler))
+	mux.HandleFunc("/volume", requireRoles(RoleListener, RoleDJ, volumeHandler))
+	mux.HandleFunc("/mode", requireRoles(RoleListener, RoleDJ, modeHandler))
+	mux.HandleFunc("/events", requireRole(RoleListener, eventsHandler))
+	mux.HandleFunc("/stream", requireRole(RoleListener, streamHandler))
+	mux.HandleFunc(LibraryPrefix, requireRoles(RoleListener, RoleDJ, libraryHandler))
+	mux.HandleFunc(LibraryPrefix+"/", requireRoles(RoleListener, RoleDJ, libraryHandler))
+	mux.HandleFunc(PlaylistsPrefix, requireRoles(RoleListener, RoleDJ, playlistsHandler))
+	mux.HandleFunc(PlaylistsPrefix+"/", requireRoles(RoleListener, RoleDJ, playlistsHandler))
+	mux.HandleFunc(SyncPrefix, requireRole(RoleFollower, syncHandler))
+	registerAPIHandlers(mux)
+}
+
+// requireDebug hide an endpoint unless debugging is on, which can change while serving
+func requireDebug(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !DebugLogging() {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// newServer create the HTTP server; its requests' contexts are cancelled when Exit begins,
+// so streams & event feeds end instead of holding up the shutdown
+func newServer(addr string, handler http.Handler) *http.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopRequests = cancel
+	shutdownDone = make(chan bool)
+	atomic.StoreInt32(&exiting, 0)
+	return &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+}
+
 func Run() {
 	// run server
 	fmt.Println("Server starting")
-	fmt.Println(Server.ListenAndServe())
+	err := Server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-shutdownDone // wait for Exit to finish cleaning up
+	}
+	fmt.Println(err)
 	fmt.Println("Server stopped after " + time.Since(StartTime).String())
 }
 
+// Exit shut down gracefully: stop accepting connections, give running requests until ShutdownTimeout to finish,
+// then stop playback and clean up the queue. Calls after the first wait for it to finish.
 func Exit() {
-	Server.Close()
+	if !atomic.CompareAndSwapInt32(&exiting, 0, 1) {
+		<-shutdownDone
+		return
+	}
+	defer close(shutdownDone)
+	fmt.Println("Server shutting down")
+	stopRequests()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := Server.Shutdown(ctx); err != nil {
+		fmt.Println("Requests still running after " + ShutdownTimeout.String() + ": " + err.Error())
+		Server.Close()
+	}
+	if Follower != nil {
+		Follower.Close()
+	}
+	if PlayerInst != nil {
+		if err := PlayerInst.Close(); err != nil {
+			fmt.Println("Player shutdown problem: " + err.Error())
+		}
+	}
+	if Rooms != nil {
+		Rooms.Close()
+	}
 }
 
 func main() {
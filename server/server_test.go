@@ -3,12 +3,72 @@
 package main
 
 import (
+	"bufio"
 	//"flag"
+	"net"
+	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
 	//flag.Parse()
 	os.Exit(m.Run())
 }
+
+func TestExit(t *testing.T) {
+	defer func(timeout time.Duration) { ShutdownTimeout, Server = timeout, nil }(ShutdownTimeout)
+	ShutdownTimeout = 5 * time.Second
+	PlayerInst = newTestPlayer()
+	PlayerInst.Enqueue(generateTestTrack(time.Second))
+	PlayerInst.Play()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() raised error %s", err)
+	}
+	Server = newServer(listener.Addr().String(), mux)
+	served := make(chan error, 1)
+	go func() { served <- Server.Serve(listener) }()
+
+	// an event feed never finishes by itself, so it mustn't hold up the shutdown
+	resp, err := http.Get("http://" + listener.Addr().String() + "/events")
+	if err != nil {
+		t.Fatalf("GET /events raised error %s", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	reader.ReadString('\n') // connected
+	// nor can a WebSocket, which the server lets go of once it's upgraded
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() raised error %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	ws := &wsConn{conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	if wsResp, wsErr := http.ReadResponse(ws.rw.Reader, nil); wsErr != nil || wsResp.StatusCode != 101 {
+		t.Fatalf("WebSocket upgrade failed: %v", wsErr)
+	}
+	start := time.Now()
+	Exit()
+	if elapsed := time.Since(start); elapsed >= ShutdownTimeout {
+		t.Errorf("Exit() waited %s for the event feed", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if opcode, _, wsErr := ws.ReadFrame(); wsErr != nil || opcode != wsOpClose {
+		t.Errorf("Expected Exit() to close the WebSocket, got %d (%v)", opcode, wsErr)
+	}
+	if _, _, wsErr := ws.ReadFrame(); wsErr == nil {
+		t.Errorf("Expected the WebSocket connection to be closed after Exit()")
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected server to be closed, got %v", err)
+	}
+	if err = PlayerInst.Close(); err == nil {
+		t.Errorf("Expected the player to be closed by Exit()")
+	}
+	Exit() // again, as a second signal would
+}
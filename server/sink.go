@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/speaker"
+)
+
+const (
+	OutputSpeaker = "speaker"
+	OutputNull    = "null"
+	OutputWav     = "wav"
+)
+
+// AudioSink output destination for the Player's streamers
+type AudioSink interface {
+	Init(sampleRate beep.SampleRate, bufferSize int) error
+	Resize(bufferSize int) error // change the buffer size, carrying on with whatever is playing
+	Play(s ...beep.Streamer)
+	Clear()
+	Lock()
+	Unlock()
+	Close() error
+}
+
+// NewAudioSink create the sink named by output (one of the Output* constants)
+func NewAudioSink(output string) (AudioSink, error) {
+	switch output {
+	case OutputSpeaker, "":
+		return &SpeakerSink{}, nil
+	case OutputNull:
+		return NewNullSink(), nil
+	case OutputWav:
+		return NewWavSink(WavPath), nil
+	}
+	return nil, errors.New("UnknownOutput")
+}
+
+var (
+	// speakerInit & speakerClose start & stop beep/speaker's output; tests swap them for a stand-in
+	speakerInit  = speaker.Init
+	speakerClose = speaker.Close
+)
+
+// SpeakerSink plays through the local sound card using beep/speaker
+type SpeakerSink struct {
+	sampleRate beep.SampleRate
+	playing    []beep.Streamer // played since the last Clear, to carry on with after a Resize
+}
+
+func (s *SpeakerSink) Init(sampleRate beep.SampleRate, bufferSize int) error {
+	s.sampleRate = sampleRate
+	s.playing = nil
+	return speakerInit(sampleRate, bufferSize)
+}
+
+// Resize re-initialise the speaker, which forgets its streamers, then play them again.
+// speaker.Init closes a running output while holding the speaker lock, which the output may be waiting for,
+// so the output is closed first, without the lock.
+func (s *SpeakerSink) Resize(bufferSize int) error {
+	if s.sampleRate == 0 {
+		return errors.New("NotInitialised")
+	}
+	speakerClose()
+	err := speakerInit(s.sampleRate, bufferSize)
+	if err != nil {
+		return err
+	}
+	speaker.Play(s.playing...)
+	return nil
+}
+
+func (s *SpeakerSink) Play(streamers ...beep.Streamer) {
+	s.playing = append(s.playing, streamers...)
+	speaker.Play(streamers...)
+}
+
+func (s *SpeakerSink) Clear() {
+	s.playing = nil
+	speaker.Clear()
+}
+
+func (s *SpeakerSink) Lock() {
+	speaker.Lock()
+}
+
+func (s *SpeakerSink) Unlock() {
+	speaker.Unlock()
+}
+
+func (s *SpeakerSink) Close() error {
+	speakerClose()
+	return nil
+}
+
+// drainSink mixes streamers and pulls from them in real time, like beep/speaker does,
+// handing every buffer of samples to write (if set)
+type drainSink struct {
+	mu         sync.Mutex
+	mixer      beep.Mixer
+	samples    [][2]float64
+	sampleRate beep.SampleRate
+	write      func(samples [][2]float64) error
+	done       chan bool
+	stopped    chan bool
+}
+
+func (d *drainSink) Init(sampleRate beep.SampleRate, bufferSize int) error {
+	if bufferSize < 1 {
+		return errors.New("InvalidBufferSize")
+	}
+	d.stop()
+	d.mu.Lock()
+	d.mixer = beep.Mixer{}
+	d.sampleRate = sampleRate
+	d.mu.Unlock()
+	d.start(bufferSize)
+	return nil
+}
+
+// Resize restart the drain with a new buffer, keeping the mixer's streamers
+func (d *drainSink) Resize(bufferSize int) error {
+	if bufferSize < 1 {
+		return errors.New("InvalidBufferSize")
+	}
+	if d.done == nil {
+		return errors.New("NotInitialised")
+	}
+	d.stop()
+	d.start(bufferSize)
+	return nil
+}
+
+// start draining in buffers of bufferSize samples
+func (d *drainSink) start(bufferSize int) {
+	d.mu.Lock()
+	d.samples = make([][2]float64, bufferSize)
+	d.done = make(chan bool)
+	d.stopped = make(chan bool)
+	d.mu.Unlock()
+	go d.run(d.done, d.stopped)
+}
+
+func (d *drainSink) run(done, stopped chan bool) {
+	defer close(stopped)
+	ticker := time.NewTicker(d.sampleRate.D(len(d.samples)))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.Lock()
+			d.mixer.Stream(d.samples)
+			d.mu.Unlock()
+			if d.write != nil {
+				d.write(d.samples)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (d *drainSink) stop() {
+	if d.done != nil {
+		close(d.done)
+		<-d.stopped
+		d.done = nil
+	}
+}
+
+func (d *drainSink) Play(s ...beep.Streamer) {
+	d.mu.Lock()
+	d.mixer.Add(s...)
+	d.mu.Unlock()
+}
+
+func (d *drainSink) Clear() {
+	d.mu.Lock()
+	d.mixer.Clear()
+	d.mu.Unlock()
+}
+
+func (d *drainSink) Lock() {
+	d.mu.Lock()
+}
+
+func (d *drainSink) Unlock() {
+	d.mu.Unlock()
+}
+
+// NullSink discards samples, draining streamers at the same pace a speaker would
+type NullSink struct {
+	drainSink
+}
+
+func NewNullSink() *NullSink {
+	return &NullSink{}
+}
+
+func (n *NullSink) Close() error {
+	n.stop()
+	return nil
+}
+
+// WavSink records everything played into a 16-bit stereo PCM WAV file
+type WavSink struct {
+	drainSink
+	path    string
+	file    *os.File
+	written uint32
+	buf     []byte
+}
+
+func NewWavSink(path string) *WavSink {
+	return &WavSink{path: path}
+}
+
+func (w *WavSink) Init(sampleRate beep.SampleRate, bufferSize int) (err error) {
+	w.stop()
+	if w.file != nil {
+		w.finalize()
+	}
+	w.file, err = os.Create(w.path)
+	if err != nil {
+		return
+	}
+	w.written = 0
+	err = w.writeHeader(sampleRate)
+	if err != nil {
+		return
+	}
+	w.buf = make([]byte, bufferSize*4)
+	w.write = w.writeSamples
+	return w.drainSink.Init(sampleRate, bufferSize)
+}
+
+// Resize carry on recording to the same file with a new buffer size
+func (w *WavSink) Resize(bufferSize int) error {
+	if bufferSize < 1 {
+		return errors.New("InvalidBufferSize")
+	}
+	if w.done == nil {
+		return errors.New("NotInitialised")
+	}
+	w.stop()
+	w.buf = make([]byte, bufferSize*4)
+	w.start(bufferSize)
+	return nil
+}
+
+func (w *WavSink) writeHeader(sampleRate beep.SampleRate) error {
+	_, err := w.file.Write(wavHeaderPCM16(sampleRate, 0)) // sizes patched in finalize
+	return err
+}
+
+// wavHeaderPCM16 build the header of a 16-bit stereo PCM WAV file holding dataSize bytes of samples
+func wavHeaderPCM16(sampleRate beep.SampleRate, dataSize uint32) []byte {
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 36+dataSize)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16) // PCM fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:22], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:24], 2)  // channels
+	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(sampleRate)*4) // byte rate
+	binary.LittleEndian.PutUint16(header[32:34], 4)                    // block align
+	binary.LittleEndian.PutUint16(header[34:36], 16)                   // bits per sample
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataSize)
+	return header
+}
+
+func (w *WavSink) writeSamples(samples [][2]float64) error {
+	encodePCM16(samples, w.buf)
+	n, err := w.file.Write(w.buf[:len(samples)*4])
+	w.written += uint32(n)
+	return err
+}
+
+// finalize patch the RIFF and data chunk sizes now that the length is known
+func (w *WavSink) finalize() error {
+	sizes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sizes, 36+w.written)
+	w.file.WriteAt(sizes, 4)
+	binary.LittleEndian.PutUint32(sizes, w.written)
+	w.file.WriteAt(sizes, 40)
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *WavSink) Close() error {
+	w.stop()
+	if w.file == nil {
+		return nil
+	}
+	return w.finalize()
+}
+
+// encodePCM16 convert samples to interleaved little-endian signed 16-bit PCM, the same way beep/speaker does
+func encodePCM16(samples [][2]float64, buf []byte) {
+	for i := range samples {
+		for c := range samples[i] {
+			val := samples[i][c]
+			if val < -1 {
+				val = -1
+			}
+			if val > +1 {
+				val = +1
+			}
+			valInt16 := int16(val * (1<<15 - 1))
+			buf[i*4+c*2+0] = byte(valInt16)
+			buf[i*4+c*2+1] = byte(valInt16 >> 8)
+		}
+	}
+}
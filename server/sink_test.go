@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/wav"
+)
+
+const (
+	testSinkRate   = beep.SampleRate(8000)
+	testWavOutFile = "deleteMeSink.wav"
+)
+
+func TestNullSinkDrains(t *testing.T) {
+	sink := NewNullSink()
+	defer sink.Close()
+	if err := sink.Init(testSinkRate, testSinkRate.N(time.Second/100)); err != nil {
+		t.Fatalf("sink.Init() raised error %s", err)
+	}
+	done := make(chan bool)
+	sink.Play(beep.Seq(beep.Silence(testSinkRate.N(time.Second/10)), beep.Callback(func() { done <- true })))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Null sink did not drain streamer")
+	}
+}
+
+func TestWavSinkRecords(t *testing.T) {
+	defer os.Remove(testWavOutFile)
+	sink := NewWavSink(testWavOutFile)
+	if err := sink.Init(testSinkRate, testSinkRate.N(time.Second/100)); err != nil {
+		t.Fatalf("sink.Init() raised error %s", err)
+	}
+	sink.Play(beep.Silence(-1))
+	time.Sleep(time.Second / 20)
+	// the recording carries on through a buffer change
+	if err := sink.Resize(testSinkRate.N(time.Second / 50)); err != nil {
+		t.Fatalf("sink.Resize() raised error %s", err)
+	}
+	time.Sleep(time.Second / 20)
+	if err := sink.Close(); err != nil {
+		t.Fatalf("sink.Close() raised error %s", err)
+	}
+	f, err := os.Open(testWavOutFile)
+	if err != nil {
+		t.Fatalf("os.Open() raised error %s", err)
+	}
+	defer f.Close()
+	streamer, format, err := wav.Decode(f)
+	if err != nil {
+		t.Fatalf("wav.Decode() raised error %s", err)
+	}
+	if format.SampleRate != testSinkRate || format.NumChannels != 2 {
+		t.Errorf("Unexpected format %+v", format)
+	}
+	if streamer.Len() < testSinkRate.N(time.Second/20) {
+		t.Errorf("Expected samples from before & after resizing, got %d", streamer.Len())
+	}
+}
+
+// fakeSpeaker stands in for beep/speaker, whose Init closes the running output while holding the lock
+// that the output takes to pull samples
+type fakeSpeaker struct {
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func (s *fakeSpeaker) Init(sampleRate beep.SampleRate, bufferSize int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Close()
+	s.done = make(chan struct{})
+	go func(done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				time.Sleep(time.Millisecond) // writing out the last buffer
+				s.mu.Lock()
+				s.mu.Unlock()
+			}
+		}
+	}(s.done)
+	return nil
+}
+
+func (s *fakeSpeaker) Close() {
+	if s.done != nil {
+		s.done <- struct{}{}
+		s.done = nil
+	}
+}
+
+func TestSpeakerSinkResize(t *testing.T) {
+	fake := &fakeSpeaker{}
+	oldInit, oldClose := speakerInit, speakerClose
+	defer func() { speakerInit, speakerClose = oldInit, oldClose }()
+	speakerInit, speakerClose = fake.Init, fake.Close
+	var sink AudioSink = &SpeakerSink{}
+	if err := sink.Init(testSinkRate, testSinkRate.N(time.Second/100)); err != nil {
+		t.Fatalf("sink.Init() raised error %s", err)
+	}
+	time.Sleep(time.Second / 20)
+	resized := make(chan error)
+	go func() { resized <- sink.Resize(testSinkRate.N(time.Second / 50)) }()
+	select {
+	case err := <-resized:
+		if err != nil {
+			t.Errorf("sink.Resize() raised error %s", err)
+		}
+		sink.Close()
+	case <-time.After(2 * time.Second):
+		// the stand-in output is stuck, so it can't be closed either
+		t.Fatalf("sink.Resize() deadlocked with the running output")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/faiface/beep"
+)
+
+const (
+	StreamFormatWav = "wav"
+	StreamFormatPCM = "pcm"
+
+	streamChannelSize = 64 // buffers queued per listener before it is considered lagging
+)
+
+// StreamSink plays through another sink (which paces the output) while sending a copy of
+// everything it plays to HTTP listeners
+type StreamSink struct {
+	AudioSink
+	mixer      beep.Mixer
+	mu         sync.Mutex
+	listeners  map[chan []byte]bool
+	sampleRate beep.SampleRate
+}
+
+// NewStreamSink wrap sink, whose output will be streamed at sampleRate until Init says otherwise
+func NewStreamSink(sink AudioSink, sampleRate beep.SampleRate) *StreamSink {
+	return &StreamSink{
+		AudioSink:  sink,
+		listeners:  map[chan []byte]bool{},
+		sampleRate: sampleRate,
+	}
+}
+
+func (s *StreamSink) Init(sampleRate beep.SampleRate, bufferSize int) error {
+	s.mu.Lock()
+	s.sampleRate = sampleRate
+	s.mu.Unlock()
+	err := s.AudioSink.Init(sampleRate, bufferSize)
+	if err != nil {
+		return err
+	}
+	// the wrapped sink only ever plays the tap; streamers are mixed here so listeners hear the same mix
+	s.AudioSink.Play(&streamTap{sink: s})
+	return nil
+}
+
+func (s *StreamSink) Play(streamers ...beep.Streamer) {
+	s.AudioSink.Lock()
+	s.mixer.Add(streamers...)
+	s.AudioSink.Unlock()
+}
+
+func (s *StreamSink) Clear() {
+	s.AudioSink.Lock()
+	s.mixer.Clear()
+	s.AudioSink.Unlock()
+}
+
+// Subscribe get a channel of 16-bit stereo PCM buffers, as they are played, and their sample rate.
+// Buffers are dropped for listeners which fall too far behind.
+func (s *StreamSink) Subscribe() (chan []byte, beep.SampleRate) {
+	ch := make(chan []byte, streamChannelSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners[ch] = true
+	return ch, s.sampleRate
+}
+
+// Unsubscribe stop sending buffers to ch and close it
+func (s *StreamSink) Unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	if s.listeners[ch] {
+		delete(s.listeners, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+}
+
+// Listeners get the number of connected listeners
+func (s *StreamSink) Listeners() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.listeners)
+}
+
+// broadcast encode samples once and hand them to every listener without blocking
+func (s *StreamSink) broadcast(samples [][2]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return
+	}
+	buf := make([]byte, len(samples)*4)
+	encodePCM16(samples, buf)
+	for ch := range s.listeners {
+		select {
+		case ch <- buf:
+		default: // listener is lagging
+		}
+	}
+}
+
+// streamTap streams the StreamSink's mix into the wrapped sink, broadcasting a copy
+type streamTap struct {
+	sink *StreamSink
+}
+
+func (t *streamTap) Stream(samples [][2]float64) (n int, ok bool) {
+	n, ok = t.sink.mixer.Stream(samples)
+	t.sink.broadcast(samples[:n])
+	return
+}
+
+func (t *streamTap) Err() error {
+	return nil
+}
+
+// swapPCM16 convert little-endian 16-bit samples to big-endian (network order), as audio/L16 requires
+func swapPCM16(buf []byte) []byte {
+	swapped := make([]byte, len(buf))
+	for i := 0; i+1 < len(buf); i += 2 {
+		swapped[i], swapped[i+1] = buf[i+1], buf[i]
+	}
+	return swapped
+}
+
+// streamHandler serve the live output as an endless WAV file, or raw PCM with ?format=pcm
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	handleChores(w, r)
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	output := streamOf(r)
+	if output == nil {
+		writeError(w, 404, "Streaming is disabled; start the server with -stream, or create the room with stream on")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = StreamFormatWav
+	}
+	if format != StreamFormatWav && format != StreamFormatPCM {
+		writeError(w, 400, fmt.Sprintf("Unsupported stream format %q; use %s or %s", format, StreamFormatWav, StreamFormatPCM))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming is not supported")
+		return
+	}
+	buffers, sampleRate := output.Subscribe()
+	defer output.Unsubscribe(buffers)
+	if DebugLogging() {
+		fmt.Printf("Stream listener connected from %s (%d listening)\n", r.RemoteAddr, output.Listeners())
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if format == StreamFormatWav {
+		w.Header().Set("Content-Type", "audio/wav")
+		w.WriteHeader(200)
+		w.Write(wavHeaderPCM16(sampleRate, 0xFFFFFFFF-36)) // unknown length
+	} else {
+		w.Header().Set("Content-Type", fmt.Sprintf("audio/L16; rate=%d; channels=2", sampleRate))
+		w.WriteHeader(200)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case buf := <-buffers:
+			if format == StreamFormatPCM {
+				buf = swapPCM16(buf)
+			}
+			_, err := w.Write(buf)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// constantStreamer streams the same sample value forever
+func constantStreamer(value float64) beep.Streamer {
+	return beep.StreamerFunc(func(samples [][2]float64) (int, bool) {
+		for i := range samples {
+			samples[i] = [2]float64{value, value}
+		}
+		return len(samples), true
+	})
+}
+
+func newTestStreamSink(t *testing.T) *StreamSink {
+	sink := NewStreamSink(NewNullSink(), testSinkRate)
+	if err := sink.Init(testSinkRate, testSinkRate.N(time.Second/100)); err != nil {
+		t.Fatalf("sink.Init() raised error %s", err)
+	}
+	return sink
+}
+
+func TestStreamSinkBroadcasts(t *testing.T) {
+	sink := newTestStreamSink(t)
+	defer sink.Close()
+	a, rate := sink.Subscribe()
+	b, _ := sink.Subscribe()
+	if rate != testSinkRate || sink.Listeners() != 2 {
+		t.Errorf("Unexpected rate %d or listener count %d", rate, sink.Listeners())
+	}
+	value := 0.5
+	sink.Play(constantStreamer(value))
+	expected := int16(value * (1<<15 - 1))
+	for _, ch := range []chan []byte{a, b} {
+		// skip any silence from before the streamer was added
+		for i := 0; i < 10; i++ {
+			buf := <-ch
+			if int16(binary.LittleEndian.Uint16(buf)) == expected {
+				break
+			}
+			if i == 9 {
+				t.Errorf("Listener did not receive played samples")
+			}
+		}
+	}
+	sink.Unsubscribe(a)
+	if sink.Listeners() != 1 {
+		t.Errorf("Expected 1 listener after Unsubscribe, got %d", sink.Listeners())
+	}
+	sink.Clear()
+}
+
+func TestStreamHandler(t *testing.T) {
+	StreamOutput = nil
+	rec := httptest.NewRecorder()
+	streamHandler(rec, httptest.NewRequest("GET", "/stream", nil))
+	if rec.Code != 404 {
+		t.Errorf("Expected status 404 while streaming is disabled, got %d", rec.Code)
+	}
+	StreamOutput = newTestStreamSink(t)
+	defer func() {
+		StreamOutput.Close()
+		StreamOutput = nil
+	}()
+	value := 0.25
+	StreamOutput.Play(constantStreamer(value))
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatalf("http.Get() raised error %s", err)
+	}
+	header := make([]byte, 48)
+	_, err = io.ReadFull(resp.Body, header)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading stream raised error %s", err)
+	}
+	if resp.Header.Get("Content-Type") != "audio/wav" || string(header[0:4]) != "RIFF" || string(header[36:40]) != "data" {
+		t.Errorf("Unexpected WAV stream start %q (%s)", header, resp.Header.Get("Content-Type"))
+	}
+	if binary.LittleEndian.Uint32(header[24:28]) != uint32(testSinkRate) {
+		t.Errorf("Unexpected WAV sample rate %d", binary.LittleEndian.Uint32(header[24:28]))
+	}
+
+	resp, err = http.Get(server.URL + "/stream?format=pcm")
+	if err != nil {
+		t.Fatalf("http.Get() raised error %s", err)
+	}
+	sample := make([]byte, 2)
+	_, err = io.ReadFull(resp.Body, sample)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Reading stream raised error %s", err)
+	}
+	if resp.Header.Get("Content-Type") != "audio/L16; rate=8000; channels=2" {
+		t.Errorf("Unexpected PCM content type %s", resp.Header.Get("Content-Type"))
+	}
+	if int16(binary.BigEndian.Uint16(sample)) != int16(value*(1<<15-1)) {
+		t.Errorf("Unexpected big-endian PCM sample %v", sample)
+	}
+
+	resp, err = http.Get(server.URL + "/stream?format=mp3")
+	if err != nil {
+		t.Fatalf("http.Get() raised error %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status 400 for unsupported format, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncFollower(t *testing.T) {
+	defer func(player *Player) { PlayerInst = player }(PlayerInst)
+	leader := newTestPlayer()
+	defer leader.Close()
+	PlayerInst = leader
+	mux := http.NewServeMux()
+	mux.HandleFunc(SyncPrefix, syncHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	leader.Enqueue(generateTestTrack(4 * time.Second))
+	leader.Enqueue(generateTestTrack(3 * time.Second))
+	leader.Play()
+	if _, err := NewSyncFollower("ftp://"+server.Listener.Addr().String(), leader, DefaultSyncTolerance); err == nil {
+		t.Errorf("Expected NewSyncFollower() to refuse a leader which isn't http")
+	}
+	followers := []*Player{newTestPlayer(), newTestPlayer()}
+	for _, p := range followers {
+		defer p.Close()
+		f, err := NewSyncFollower(server.URL+"/", p, DefaultSyncTolerance)
+		if err != nil {
+			t.Fatalf("NewSyncFollower() raised error %s", err)
+		}
+		f.Start()
+		defer f.Close()
+	}
+
+	// the tracks have different lengths, so matching lengths means matching tracks
+	inSync := func(p *Player) bool {
+		expected := leader.Timeline()
+		tl := p.Timeline()
+		drift := tl.Position - expected.Position
+		return tl.Playing && tl.Paused == expected.Paused && tl.Length == expected.Length &&
+			drift < 100*time.Millisecond && drift > -100*time.Millisecond
+	}
+	for step, action := range []func(){
+		func() {},
+		leader.Next,
+		leader.Pause,
+		leader.Play,
+	} {
+		action()
+		for i, p := range followers {
+			if !waitFor(3*time.Second, func() bool { return inSync(p) }) {
+				t.Errorf("Follower %d out of sync after step %d: %+v, leader %+v", i, step, p.Timeline(), leader.Timeline())
+			}
+		}
+	}
+	if tl := followers[0].Timeline(); tl.Length != 3*time.Second {
+		t.Errorf("Expected follower to play the leader's second track, got %+v", tl)
+	}
+}
+
+func TestSyncTracks(t *testing.T) {
+	defer func(player *Player) { PlayerInst = player }(PlayerInst)
+	leader := newTestPlayer()
+	defer leader.Close()
+	PlayerInst = leader
+	leader.Enqueue(generateTestTrack(time.Second))
+	entry, _ := leader.Entry(0)
+
+	req := httptest.NewRequest("GET", SyncPrefix+"tracks/0", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rec := httptest.NewRecorder()
+	syncHandler(rec, req)
+	if rec.Code != 206 || rec.Body.String() != "RIFF" || rec.Header().Get("Content-Type") != entry.Meta.Type {
+		t.Errorf("Unexpected partial track response %d %q (%s)", rec.Code, rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest("GET", SyncPrefix+"tracks/0", nil))
+	if rec.Code != 200 || int64(rec.Body.Len()) != entry.Meta.Size {
+		t.Errorf("Expected the whole track (%d bytes), got %d with %d bytes", entry.Meta.Size, rec.Code, rec.Body.Len())
+	}
+	rec = httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest("GET", SyncPrefix+"tracks/1", nil))
+	if rec.Code != 404 {
+		t.Errorf("Expected 404 for a track which isn't queued, got %d", rec.Code)
+	}
+}
+
+func TestSyncTracksOnlyAudio(t *testing.T) {
+	defer func(player *Player) { PlayerInst = player }(PlayerInst)
+	defer setAllowedFormats(nil)
+	leader := NewPlayer(NewNullSink())
+	leader.QueueConfig.AudioOnly = false // to get something else into the queue
+	leader.Init()
+	defer leader.Close()
+	PlayerInst = leader
+	leader.Enqueue(generateTestTrack(time.Second))
+	leader.Enqueue(NewWrapCloser(strings.NewReader(`{"tokens": [{"token": "s3cret", "role": "admin"}]}`)))
+
+	rec := httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest("GET", SyncPrefix+"tracks/1", nil))
+	if rec.Code != 404 || strings.Contains(rec.Body.String(), "s3cret") {
+		t.Errorf("Expected 404 for a queue item which isn't audio, got %d %s", rec.Code, rec.Body)
+	}
+	setAllowedFormats(map[string]bool{MimeMP3: true})
+	rec = httptest.NewRecorder()
+	syncHandler(rec, httptest.NewRequest("GET", SyncPrefix+"tracks/0", nil))
+	if rec.Code != 415 {
+		t.Errorf("Expected 415 for a track in a format which isn't allowed, got %d", rec.Code)
+	}
+
+	// listeners can't copy tracks, only followers
+	Auth = NewAuthenticator(AuthConfig{Tokens: []AuthToken{
+		{Name: "kiosk", Token: "listen", Role: RoleListener},
+		{Name: "kitchen", Token: "follow", Role: RoleFollower},
+	}})
+	defer func() { Auth = nil }()
+	mux := http.NewServeMux()
+	registerPlayerHandlers(mux)
+	for token, expected := range map[string]int{"listen": 403, "follow": 200} {
+		req := httptest.NewRequest("GET", SyncPrefix+"clock", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("Expected status %d for the %s token, got %d", expected, token, rec.Code)
+		}
+	}
+}
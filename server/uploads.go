@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	UploadsDirname = "uploads"
+	UploadsGrace   = 10 * time.Minute // uploads this recent are never pruned, so they can be queued before anything uses them
+	uploadTmpStart = "upload.tmp"
+)
+
+// UploadStore content-addressed store of uploaded files.
+// Files are named by the SHA-256 of their contents, so the same upload is only stored once.
+type UploadStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewUploadStore(dir string) (*UploadStore, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(absDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadStore{dir: absDir}, nil
+}
+
+// filename the file an upload with the hex-encoded hash is stored in
+func (s *UploadStore) filename(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+// Put store everything read from r, returning its hex-encoded SHA-256 and the file it is stored in
+func (s *UploadStore) Put(r io.Reader) (hash, filename string, err error) {
+	tmp, err := ioutil.TempFile(s.dir, uploadTmpStart)
+	if err != nil {
+		return
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	filename = s.filename(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, statErr := os.Stat(filename); statErr == nil {
+		// already stored; keep it from being pruned before it's queued again
+		os.Remove(tmp.Name())
+		now := time.Now()
+		err = os.Chtimes(filename, now, now)
+		return
+	}
+	err = os.Rename(tmp.Name(), filename)
+	return
+}
+
+// Prune remove stored files which aren't in inUse (by filename), along with uploads which never finished
+func (s *UploadStore) Prune(inUse map[string]bool) (removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		filename := filepath.Join(s.dir, info.Name())
+		if info.IsDir() || inUse[filename] || time.Since(info.ModTime()) < UploadsGrace {
+			continue
+		}
+		if os.Remove(filename) == nil {
+			removed++
+		}
+	}
+	return
+}
+
+// uploadsInUse the files which queues and playlists still refer to
+func uploadsInUse() map[string]bool {
+	inUse := map[string]bool{}
+	for _, player := range allPlayers() {
+		for _, entry := range player.Entries() {
+			if entry.Meta.Path != "" {
+				inUse[entry.Meta.Path] = true
+			}
+		}
+	}
+	if Playlists != nil {
+		summaries, _ := Playlists.List()
+		for _, summary := range summaries {
+			playlist, err := Playlists.Get(summary.Name)
+			if err != nil {
+				continue
+			}
+			for _, entry := range playlist.Entries {
+				if fullPath, err := resolvePlaylistPath(entry.Path); err == nil {
+					if absPath, err := filepath.Abs(fullPath); err == nil {
+						inUse[absPath] = true
+					}
+				}
+			}
+		}
+	}
+	return inUse
+}
+
+// pruneUploads remove uploads which nothing refers to any more
+func pruneUploads() {
+	if Uploads == nil {
+		return
+	}
+	removed, err := Uploads.Prune(uploadsInUse())
+	if err != nil {
+		fmt.Println("Unable to prune uploads: " + err.Error())
+	} else if removed != 0 && DebugLogging() {
+		fmt.Printf("Pruned %d unused uploads\n", removed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iomuploads")
+	defer os.RemoveAll(dir)
+	store, err := NewUploadStore(filepath.Join(dir, UploadsDirname))
+	if err != nil {
+		t.Fatalf("NewUploadStore() raised error %s", err)
+	}
+	hash, filename, err := store.Put(bytes.NewReader([]byte("a song")))
+	if err != nil {
+		t.Fatalf("Put() raised error %s", err)
+	}
+	if sum := sha256.Sum256([]byte("a song")); hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the hex-encoded SHA-256 of the contents, got %q", hash)
+	}
+	againHash, againFilename, _ := store.Put(bytes.NewReader([]byte("a song")))
+	otherHash, otherFilename, _ := store.Put(bytes.NewReader([]byte("another song")))
+	if againHash != hash || againFilename != filename || otherHash == hash || otherFilename == filename {
+		t.Errorf("Expected the same contents to share a file, got %s %s and %s %s for the same and %s %s for different", hash, filename, againHash, againFilename, otherHash, otherFilename)
+	}
+	if infos, _ := ioutil.ReadDir(filepath.Join(dir, UploadsDirname)); len(infos) != 2 {
+		t.Errorf("Expected 2 stored files, got %d", len(infos))
+	}
+
+	if removed, _ := store.Prune(map[string]bool{}); removed != 0 {
+		t.Errorf("Expected recent uploads not to be pruned, but %d were", removed)
+	}
+	old := time.Now().Add(-2 * UploadsGrace)
+	os.Chtimes(filename, old, old)
+	os.Chtimes(otherFilename, old, old)
+	removed, err := store.Prune(map[string]bool{filename: true})
+	if err != nil || removed != 1 {
+		t.Errorf("Expected 1 unused upload to be pruned, got %d (error %v)", removed, err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("Expected the upload in use to be kept, got %s", err)
+	}
+}
+
+func TestMusicUploadDeduplication(t *testing.T) {
+	defer func(root string, maxMemory int64) { RootPath, MaxMemory, Uploads = root, maxMemory, nil }(RootPath, MaxMemory)
+	MaxMemory = DefaultMaxMemory
+	RootPath, _ = ioutil.TempDir("", "iom")
+	defer os.RemoveAll(RootPath)
+	var err error
+	Uploads, err = NewUploadStore(filepath.Join(RootPath, UploadsDirname))
+	if err != nil {
+		t.Fatalf("NewUploadStore() raised error %s", err)
+	}
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	defer PlayerInst.Close()
+	track, _ := ioutil.ReadAll(generateTestTrack(time.Second))
+	submission := `{"files": [{"name": "a", "data": "` + base64.StdEncoding.EncodeToString(track) + `"}]}`
+
+	var first, second musicQueuedBody
+	json.Unmarshal(doMusicJSON(submission).Body.Bytes(), &first)
+	json.Unmarshal(doMusicJSON(submission).Body.Bytes(), &second)
+	if len(first.Queued) != 1 || len(first.Queued[0].AlreadyQueued) != 0 || first.Queued[0].SHA256 == "" {
+		t.Fatalf("Unexpected first upload response %+v", first)
+	}
+	if len(second.Queued) != 1 || second.Queued[0].Index != 1 || second.Queued[0].SHA256 != first.Queued[0].SHA256 ||
+		len(second.Queued[0].AlreadyQueued) != 1 || second.Queued[0].AlreadyQueued[0] != 0 {
+		t.Errorf("Expected the second upload to be reported as already in the queue, got %+v", second)
+	}
+	if infos, _ := ioutil.ReadDir(filepath.Join(RootPath, UploadsDirname)); len(infos) != 1 {
+		t.Errorf("Expected both uploads to share 1 stored file, got %d", len(infos))
+	}
+	entry, err := PlayerInst.Entry(1)
+	if err != nil || entry.Meta.Path != filepath.Join(Uploads.dir, first.Queued[0].SHA256) {
+		t.Errorf("Expected queue items to refer to the stored upload, got %+v (error %v)", entry, err)
+	}
+}
+
+func doMusicForm(name string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", name)
+	part.Write(data)
+	form.Close()
+	req := httptest.NewRequest("POST", "/music", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	musicHandler(rec, req)
+	return rec
+}
+
+func TestMusicFormUploadStreamed(t *testing.T) {
+	defer func(root string, maxMemory int64) { RootPath, MaxMemory, Uploads = root, maxMemory, nil }(RootPath, MaxMemory)
+	MaxMemory = 1024 // smaller than the track, which must not be held in memory
+	RootPath, _ = ioutil.TempDir("", "iom")
+	defer os.RemoveAll(RootPath)
+	PlayerInst = NewPlayer(NewNullSink())
+	PlayerInst.Init()
+	defer PlayerInst.Close()
+	track, _ := ioutil.ReadAll(generateTestTrack(time.Second))
+
+	if rec := doMusicForm("a.wav", track); rec.Code != 413 {
+		t.Errorf("Expected an upload over MaxMemory without an upload store to be rejected with 413, got %d", rec.Code)
+	}
+	var err error
+	Uploads, err = NewUploadStore(filepath.Join(RootPath, UploadsDirname))
+	if err != nil {
+		t.Fatalf("NewUploadStore() raised error %s", err)
+	}
+	rec := doMusicForm("a.wav", track)
+	var queued musicQueuedBody
+	json.Unmarshal(rec.Body.Bytes(), &queued)
+	sum := sha256.Sum256(track)
+	if rec.Code != 200 || len(queued.Queued) != 1 || queued.Queued[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected the upload to be streamed to the store, got %d %s", rec.Code, rec.Body.String())
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(Uploads.dir, queued.Queued[0].SHA256))
+	if err != nil || !bytes.Equal(stored, track) {
+		t.Errorf("Expected the stored upload to match the track (error %v)", err)
+	}
+	if rec := doMusicForm("b.txt", []byte("not audio")); rec.Code != 415 {
+		t.Errorf("Expected an unsupported upload to be rejected with 415, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Minimal server side of RFC 6455, enough to push messages to browsers
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsAcceptGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxPayloadBytes = 1 << 16 // clients only need to send control frames
+)
+
+// allowedOrigins origins of other sites' pages which may open WebSockets, as well as this server's own
+var allowedOrigins map[string]bool
+
+// parseOrigins turn a comma-separated list of origins, like https://example.com, into a set
+func parseOrigins(value string) map[string]bool {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// sameOrigin whether a WebSocket handshake comes from a page on this server or an allowed origin.
+// Browsers always send Origin, so a handshake without one isn't from a web page.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowedOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originURL.Host, r.Host)
+}
+
+type wsConn struct {
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex
+}
+
+// isWebSocketUpgrade check whether a request is a WebSocket opening handshake
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept compute the Sec-WebSocket-Accept value for a client's key
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeWebSocket complete the opening handshake, taking over the request's connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	// otherwise any site could use a visitor's credentials to listen in
+	if !sameOrigin(r) {
+		writeError(w, 403, "WebSocket origin "+r.Header.Get("Origin")+" is not allowed")
+		return nil, errors.New("ForbiddenOrigin")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, 400, "Unsupported WebSocket handshake")
+		return nil, errors.New("BadHandshake")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, 500, "Connection cannot be upgraded")
+		return nil, errors.New("HijackUnsupported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// WriteFrame send a single unfragmented, unmasked frame; safe to call concurrently
+func (c *wsConn) WriteFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	_, err := c.rw.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = c.rw.Write(payload)
+	if err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// ReadFrame receive the next frame, unmasking its payload. Fragments are returned as they arrive.
+func (c *wsConn) ReadFrame() (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	_, err = io.ReadFull(c.rw, header)
+	if err != nil {
+		return
+	}
+	opcode = header[0] & 0x0F
+	isMasked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.rw, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.rw, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return
+	}
+	if length > wsMaxPayloadBytes {
+		err = errors.New("FrameTooLarge")
+		return
+	}
+	mask := make([]byte, 4)
+	if isMasked {
+		_, err = io.ReadFull(c.rw, mask)
+		if err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}